@@ -6,76 +6,341 @@ package sample
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
 
+// apiHandler implements the CarInfoStore API on top of a CarStore.
+type apiHandler struct {
+	store CarStore
+}
+
+// storeFor returns the store to use while serving the request, which traces
+// each operation as part of the request's trace.
+func (a *apiHandler) storeFor(r *http.Request) CarStore {
+	return &tracedStore{store: a.store, ctx: r.Context()}
+}
+
+// writeAttempts is the number of times a handler will retry a write which
+// depends on a value it read earlier, in case other requests keep changing
+// that value in between. For example, postCars retries if another request
+// claims the car ID it picked first.
+const writeAttempts = 5
+
+// etag formats a revision as an HTTP entity tag.
+func etag(rev uint64) string {
+	return fmt.Sprintf("\"%d\"", rev)
+}
+
+// preconditionFromRequest builds a Precondition from the If-Match and
+// If-None-Match headers of the request, following RFC 7232. It returns nil
+// if neither header is present.
+func preconditionFromRequest(r *http.Request) Precondition {
+	ifMatch := r.Header.Values("If-Match")
+	ifNoneMatch := r.Header.Values("If-None-Match")
+	if len(ifMatch) == 0 && len(ifNoneMatch) == 0 {
+		return nil
+	}
+
+	return func(rev uint64) bool {
+		if len(ifMatch) > 0 && !etagListMatches(ifMatch, rev, false) {
+			return false
+		}
+
+		if len(ifNoneMatch) > 0 && etagListMatches(ifNoneMatch, rev, true) {
+			return false
+		}
+
+		return true
+	}
+}
+
+// etagListMatches returns true if any entity tag listed in the header values
+// matches the revision. "*" matches any revision of a record that exists.
+// Weak tags (W/"...") only match if weak is true, per the weak comparison
+// function of RFC 7232.
+func etagListMatches(values []string, rev uint64, weak bool) bool {
+	if rev == 0 {
+		// The record does not exist, so nothing can match it.
+		return false
+	}
+
+	current := etag(rev)
+	for _, value := range values {
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" {
+				return true
+			}
+
+			if strings.HasPrefix(tag, "W/") {
+				if !weak {
+					continue
+				}
+				tag = strings.TrimPrefix(tag, "W/")
+			}
+
+			if tag == current {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// authorFromRequest returns the Author to record in the history for changes
+// made by the request. If the request was not authorized by an
+// EntitlementsHandler, the author is taken to be the "User" header, with no
+// decision ID.
+func authorFromRequest(r *http.Request) Author {
+	if author, ok := AuthorFromContext(r.Context()); ok {
+		return author
+	}
+
+	return Author{Subject: r.Header.Get("User")}
+}
+
+// writeJSON encodes the value as the JSON response. If field-level
+// entitlements are in effect, the fields the subject may not read are
+// omitted. The resource should be HistoryCar or HistoryStatus.
+func writeJSON(w http.ResponseWriter, r *http.Request, resource string, value interface{}) {
+	if access, ok := FieldAccessFromContext(r.Context()); ok {
+		redacted, err := access.Redact(resource, value)
+		if err != nil {
+			jsonError(w, "failed to redact response", err, 500)
+			return
+		}
+		value = redacted
+	}
+
+	encodeJSON(w, r, http.StatusOK, value)
+}
+
+// encodeJSON encodes the value as the JSON response with the given status
+// code, in a span of its own. Handlers whose responses need redacting must
+// have redacted them already, or use writeJSON instead.
+func encodeJSON(w http.ResponseWriter, r *http.Request, code int, value interface{}) {
+	_, span := tracer.Start(r.Context(), "writeJSON")
+	defer span.End()
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(value)
+}
+
+// unmarshalBody decodes the request body into target. If field-level
+// entitlements are in effect, the fields the subject may not write are
+// carried over from current, which is nil for a new record. If it fails, it
+// writes an error response and returns false.
+func unmarshalBody(w http.ResponseWriter, r *http.Request, body []byte, resource string, current interface{}, target interface{}) bool {
+	var err error
+	if access, ok := FieldAccessFromContext(r.Context()); ok {
+		err = access.Merge(resource, body, current, target)
+	} else {
+		err = json.Unmarshal(body, target)
+	}
+
+	var fieldErr *FieldError
+	if errors.As(err, &fieldErr) {
+		jsonError(w, "request prohibited by Entitlements policy", err, 403)
+		return false
+	} else if err != nil {
+		jsonError(w, "failed to unmarshal request body", err, 400)
+		return false
+	}
+
+	return true
+}
+
+// decodeBody is like unmarshalBody, for a write which will replace the record
+// whose current value and revision are returned by get. It returns the
+// Precondition that the write should use.
+//
+// If field-level entitlements are in effect, the current value is needed to
+// decode the body. In that case, the Precondition that is returned (which
+// includes the one from the request) also requires that the record has not
+// changed since it was read, and retry is true, indicating that the caller
+// should call decodeBody again if the write fails with ErrPreconditionFailed.
+func decodeBody(w http.ResponseWriter, r *http.Request, body []byte, resource string, get func() (interface{}, uint64, error), target interface{}) (pre Precondition, retry bool, ok bool) {
+	pre = preconditionFromRequest(r)
+
+	if _, restricted := FieldAccessFromContext(r.Context()); !restricted {
+		return pre, false, unmarshalBody(w, r, body, resource, nil, target)
+	}
+
+	current, rev, err := get()
+	if err != nil {
+		jsonError(w, "failed to get current value", err, 500)
+		return nil, false, false
+	}
+
+	// Check the request's own precondition now, so that we don't retry
+	// if it is the one that fails.
+	err = pre.check(rev)
+	if err != nil {
+		storeError(w, "precondition failed", err)
+		return nil, false, false
+	}
+
+	if rev == 0 {
+		current = nil
+	}
+
+	if !unmarshalBody(w, r, body, resource, current, target) {
+		return nil, false, false
+	}
+
+	return func(r uint64) bool { return r == rev }, true, true
+}
+
+// storeError reports an error returned by the CarStore, using 412 if it was
+// caused by a failed Precondition, and 404 if the car does not exist.
+func storeError(w http.ResponseWriter, message string, err error) {
+	if errors.Is(err, ErrPreconditionFailed) {
+		jsonError(w, message, err, 412)
+		return
+	}
+
+	if errors.Is(err, ErrCarNotFound) {
+		jsonError(w, message, err, 404)
+		return
+	}
+
+	jsonError(w, message, err, 500)
+}
+
 // getCars handles GET /cars, returning a list of car objects.
-func getCars(w http.ResponseWriter, r *http.Request) {
-	ids := GetCarIDs()
+func (a *apiHandler) getCars(w http.ResponseWriter, r *http.Request) {
+	ids, err := a.storeFor(r).GetCarIDs()
+	if err != nil {
+		jsonError(w, "failed to list cars", err, 500)
+		return
+	}
+
+	// If the Entitlements policy is being checked per car, only include
+	// the cars the subject may GET individually.
+	if filter, ok := ItemFilterFromContext(r.Context()); ok {
+		resources := make([]string, len(ids))
+		for i, id := range ids {
+			resources[i] = "/cars/" + id
+		}
+
+		allowed, err := filter("GET", resources)
+		if errors.Is(err, ErrDecisionTimeout) || errors.Is(err, ErrCircuitOpen) {
+			jsonError(w, "OPA is unavailable to filter cars", err, 503)
+			return
+		} else if err != nil {
+			jsonError(w, "failed to filter cars", err, 500)
+			return
+		}
+
+		visible := []string{}
+		for i, id := range ids {
+			if allowed[i] {
+				visible = append(visible, id)
+			}
+		}
+		ids = visible
+	}
+
 	cars := make(map[string]Car)
 	for _, id := range ids {
-		var ok bool
-		cars[id], ok = GetCar(id)
-		if !ok {
+		car, rev, err := a.storeFor(r).GetCar(id)
+		if err != nil {
+			jsonError(w, fmt.Sprintf("failed to get car '%s'", id), err, 500)
+			return
+		}
+		if rev == 0 {
 			jsonError(w, fmt.Sprintf("have id '%s', but not matching car", id), nil, 500)
 			return
 		}
+		cars[id] = car
 	}
 
-	w.Header().Add("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(cars)
+	if access, ok := FieldAccessFromContext(r.Context()); ok {
+		redacted := map[string]interface{}{}
+		for id, car := range cars {
+			redacted[id], err = access.Redact(HistoryCar, car)
+			if err != nil {
+				jsonError(w, "failed to redact response", err, 500)
+				return
+			}
+		}
+
+		encodeJSON(w, r, http.StatusOK, redacted)
+		return
+	}
+
+	encodeJSON(w, r, http.StatusOK, cars)
 }
 
 // postCars handles POST /cars. It expects a Car object and returns the ID of
 // the car created.
-func postCars(w http.ResponseWriter, r *http.Request) {
+func (a *apiHandler) postCars(w http.ResponseWriter, r *http.Request) {
 	car := &Car{}
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		jsonError(w, "failed to read request body", err, 400)
 		return
 	}
-	err = json.Unmarshal(body, car)
-	if err != nil {
-		jsonError(w, "failed to unmarshal request body", err, 400)
+
+	if !unmarshalBody(w, r, body, HistoryCar, nil, car) {
 		return
 	}
 
-	id := NextCarID()
-	if SetCar(id, *car) {
-		// the car already existed
-		w.WriteHeader(200)
-	} else {
-		// the car has been created for the first time
-		w.WriteHeader(201)
-	}
+	// Another request may claim the ID we picked before we get to store
+	// the car, so we only store it if the ID is still unused, and try
+	// again with a new ID otherwise.
+	var id string
+	var rev uint64
+	for attempt := 0; attempt < writeAttempts; attempt++ {
+		id, err = a.storeFor(r).NextCarID()
+		if err != nil {
+			jsonError(w, "failed to allocate car ID", err, 500)
+			return
+		}
 
-	go SaveToDisk()
+		_, rev, err = a.storeFor(r).SetCar(id, *car, func(rev uint64) bool { return rev == 0 }, authorFromRequest(r))
+		if !errors.Is(err, ErrPreconditionFailed) {
+			break
+		}
+	}
+	if err != nil {
+		jsonError(w, "failed to store car", err, 500)
+		return
+	}
 
-	w.Header().Add("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(id)
+	// The car is always created for the first time.
+	w.Header().Set("ETag", etag(rev))
+	encodeJSON(w, r, 201, id)
 }
 
 // getCarByID handles GET /cars/{carid}
-func getCarByID(w http.ResponseWriter, r *http.Request) {
+func (a *apiHandler) getCarByID(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
-	car, ok := GetCar(id)
-	if !ok {
+	car, rev, err := a.storeFor(r).GetCar(id)
+	if err != nil {
+		jsonError(w, fmt.Sprintf("failed to get car '%s'", id), err, 500)
+		return
+	}
+	if rev == 0 {
 		jsonError(w, fmt.Sprintf("no such car with ID '%s'", id), nil, 404)
 		return
 	}
 
-	w.Header().Add("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(car)
+	w.Header().Set("ETag", etag(rev))
+	writeJSON(w, r, HistoryCar, car)
 }
 
 // putCarByID handles PUT /cars/{carid}
-func putCarByID(w http.ResponseWriter, r *http.Request) {
+func (a *apiHandler) putCarByID(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
 	if !ValidateID(id) {
@@ -83,21 +348,34 @@ func putCarByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	car := &Car{}
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		jsonError(w, "failed to read request body", err, 400)
 		return
 	}
-	err = json.Unmarshal(body, car)
+
+	getCar := func() (interface{}, uint64, error) { return a.storeFor(r).GetCar(id) }
+
+	var prev, rev uint64
+	for attempt := 0; attempt < writeAttempts; attempt++ {
+		car := &Car{}
+		pre, retry, ok := decodeBody(w, r, body, HistoryCar, getCar, car)
+		if !ok {
+			return
+		}
+
+		prev, rev, err = a.storeFor(r).SetCar(id, *car, pre, authorFromRequest(r))
+		if !retry || !errors.Is(err, ErrPreconditionFailed) {
+			break
+		}
+	}
 	if err != nil {
-		jsonError(w, "failed to unmarshal request body", err, 400)
+		storeError(w, "failed to store car", err)
 		return
 	}
 
-	go SaveToDisk()
-
-	if SetCar(id, *car) {
+	w.Header().Set("ETag", etag(rev))
+	if prev != 0 {
 		// the car already existed
 		w.WriteHeader(200)
 	} else {
@@ -107,37 +385,48 @@ func putCarByID(w http.ResponseWriter, r *http.Request) {
 }
 
 // deleteCarByID handles DELETE /cars/{carid}
-func deleteCarByID(w http.ResponseWriter, r *http.Request) {
+func (a *apiHandler) deleteCarByID(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
-	DeleteCar(id)
-	go SaveToDisk()
+	err := a.storeFor(r).DeleteCar(id, preconditionFromRequest(r), authorFromRequest(r))
+	if err != nil {
+		storeError(w, "failed to delete car", err)
+		return
+	}
 }
 
 // putStatus handles PUT /cars/{carid}/status
-func putStatus(w http.ResponseWriter, r *http.Request) {
+func (a *apiHandler) putStatus(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
-	status := &Status{}
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		jsonError(w, "failed to read request body", err, 400)
 		return
 	}
-	err = json.Unmarshal(body, status)
-	if err != nil {
-		jsonError(w, "failed to unmarshal request body", err, 400)
-		return
-	}
 
-	exists, err := SetStatus(id, *status)
+	getStatus := func() (interface{}, uint64, error) { return a.storeFor(r).GetStatus(id) }
+
+	var prev, rev uint64
+	for attempt := 0; attempt < writeAttempts; attempt++ {
+		status := &Status{}
+		pre, retry, ok := decodeBody(w, r, body, HistoryStatus, getStatus, status)
+		if !ok {
+			return
+		}
+
+		prev, rev, err = a.storeFor(r).SetStatus(id, *status, pre, authorFromRequest(r))
+		if !retry || !errors.Is(err, ErrPreconditionFailed) {
+			break
+		}
+	}
 	if err != nil {
-		jsonError(w, "failed to set status", err, 500)
+		storeError(w, "failed to set status", err)
+		return
 	}
 
-	go SaveToDisk()
-
-	if exists {
+	w.Header().Set("ETag", etag(rev))
+	if prev != 0 {
 		// the status already existed
 		w.WriteHeader(200)
 	} else {
@@ -147,28 +436,91 @@ func putStatus(w http.ResponseWriter, r *http.Request) {
 }
 
 // getStatus GET /cars/{carid}/status
-func getStatus(w http.ResponseWriter, r *http.Request) {
+func (a *apiHandler) getStatus(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
-	status, ok := GetStatus(id)
-	if !ok {
+	status, rev, err := a.storeFor(r).GetStatus(id)
+	if err != nil {
+		jsonError(w, fmt.Sprintf("failed to get status for car '%s'", id), err, 500)
+		return
+	}
+	if rev == 0 {
 		jsonError(w, fmt.Sprintf("no status for car with ID '%s'", id), nil, 404)
 		return
 	}
 
-	w.Header().Add("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(status)
+	w.Header().Set("ETag", etag(rev))
+	writeJSON(w, r, HistoryStatus, status)
 }
 
-func GetAPIHandler() http.Handler {
+// getHistory handles GET /cars/{carid}/history
+func (a *apiHandler) getHistory(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	history, err := a.storeFor(r).GetHistory(id)
+	if err != nil {
+		jsonError(w, fmt.Sprintf("failed to get history for car '%s'", id), err, 500)
+		return
+	}
+
+	if len(history) == 0 {
+		// A car which exists but was never changed through the API,
+		// e.g. one imported from old data, has an empty history.
+		_, rev, err := a.storeFor(r).GetCar(id)
+		if err != nil {
+			jsonError(w, fmt.Sprintf("failed to get car '%s'", id), err, 500)
+			return
+		}
+		if rev == 0 {
+			jsonError(w, fmt.Sprintf("no history for car with ID '%s'", id), nil, 404)
+			return
+		}
+	}
+
+	// The history may contain values of fields that the subject may not
+	// read.
+	if access, ok := FieldAccessFromContext(r.Context()); ok {
+		for i := range history {
+			h := &history[i]
+			if h.Previous, err = access.RedactRaw(h.Resource, h.Previous); err == nil {
+				h.New, err = access.RedactRaw(h.Resource, h.New)
+			}
+			if err != nil {
+				jsonError(w, "failed to redact response", err, 500)
+				return
+			}
+		}
+	}
+
+	encodeJSON(w, r, http.StatusOK, history)
+}
+
+// APIRouteTemplates returns the templates of the routes served by the
+// handler GetAPIHandler() returns, e.g. for use with WithRouteTemplates().
+func APIRouteTemplates() RouteTemplates {
+	routes, err := ParseRouteTemplates([]string{"/cars", "/cars/{id}", "/cars/{id}/status", "/cars/{id}/history"})
+	if err != nil {
+		// should never happen
+		panic(err)
+	}
+	return routes
+}
+
+// GetAPIHandler creates a router for the CarInfoStore API, backed by the
+// given store.
+func GetAPIHandler(store CarStore) http.Handler {
+	a := &apiHandler{store: store}
+
 	router := mux.NewRouter()
-	router.HandleFunc("/cars", getCars).Methods("GET")
-	router.HandleFunc("/cars", postCars).Methods("POST")
-	router.HandleFunc("/cars/{id}", getCarByID).Methods("GET")
-	router.HandleFunc("/cars/{id}", putCarByID).Methods("PUT")
-	router.HandleFunc("/cars/{id}", deleteCarByID).Methods("DELETE")
-	router.HandleFunc("/cars/{id}/status", getStatus).Methods("GET")
-	router.HandleFunc("/cars/{id}/status", putStatus).Methods("PUT")
+	router.HandleFunc("/cars", a.getCars).Methods("GET")
+	router.HandleFunc("/cars", a.postCars).Methods("POST")
+	router.HandleFunc("/cars/{id}", a.getCarByID).Methods("GET")
+	router.HandleFunc("/cars/{id}", a.putCarByID).Methods("PUT")
+	router.HandleFunc("/cars/{id}", a.deleteCarByID).Methods("DELETE")
+	router.HandleFunc("/cars/{id}/status", a.getStatus).Methods("GET")
+	router.HandleFunc("/cars/{id}/status", a.putStatus).Methods("PUT")
+	router.HandleFunc("/cars/{id}/history", a.getHistory).Methods("GET")
+	router.Use(instrumentAPI)
 
 	return router
 }
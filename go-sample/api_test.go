@@ -0,0 +1,157 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var (
+	spanRecorder     *tracetest.SpanRecorder
+	spanRecorderOnce sync.Once
+)
+
+// recordSpans returns a function which returns the spans that have ended
+// since recordSpans was called. The package's tracer only ever delegates to
+// the first TracerProvider installed, so a single one is shared by all
+// tests.
+func recordSpans() func() []sdktrace.ReadOnlySpan {
+	spanRecorderOnce.Do(func() {
+		spanRecorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+	})
+
+	start := len(spanRecorder.Ended())
+	return func() []sdktrace.ReadOnlySpan {
+		return spanRecorder.Ended()[start:]
+	}
+}
+
+// serveAPI sends a request to the handler, and returns the response.
+func serveAPI(t *testing.T, handler http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+func TestAPIResponsesAreTraced(t *testing.T) {
+	store := loadJSONFileStore(t, t.TempDir())
+	defer store.Close()
+	handler := GetAPIHandler(store)
+
+	w := serveAPI(t, handler, "POST", "/cars", `{"make": "Honda"}`)
+	if w.Code != 201 {
+		t.Fatalf("POST /cars: expected 201, got %d: %s", w.Code, w.Body)
+	}
+
+	for _, test := range []struct {
+		method, path string
+		code         int
+	}{
+		{"GET", "/cars", 200},
+		{"GET", "/cars/car0", 200},
+		{"GET", "/cars/car0/history", 200},
+		{"POST", "/cars", 201},
+	} {
+		ended := recordSpans()
+
+		w := serveAPI(t, handler, test.method, test.path, `{"make": "Ford"}`)
+		if w.Code != test.code {
+			t.Errorf("%s %s: expected %d, got %d: %s", test.method, test.path, test.code, w.Code, w.Body)
+		}
+		if w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s: unexpected Content-Type '%s'", test.method, test.path, w.Header().Get("Content-Type"))
+		}
+
+		traced := false
+		for _, span := range ended() {
+			if span.Name() == "writeJSON" {
+				traced = true
+			}
+		}
+		if !traced {
+			t.Errorf("%s %s: response was not written in a writeJSON span", test.method, test.path)
+		}
+	}
+}
+
+// testStores returns a freshly loaded store of each kind.
+func testStores(t *testing.T) map[string]CarStore {
+	bolt, err := NewBoltStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bolt.Close() })
+
+	js := loadJSONFileStore(t, t.TempDir())
+	t.Cleanup(func() { js.Close() })
+
+	return map[string]CarStore{"bolt": bolt, "json": js}
+}
+
+func TestAPIPutStatusOfMissingCar(t *testing.T) {
+	for name, store := range testStores(t) {
+		handler := GetAPIHandler(store)
+
+		w := serveAPI(t, handler, "PUT", "/cars/car7/status", `{"sold": true}`)
+		if w.Code != 404 {
+			t.Errorf("%s: expected 404, got %d: %s", name, w.Code, w.Body)
+		}
+	}
+}
+
+func TestAPIDeleteCarKeepsHistory(t *testing.T) {
+	for name, store := range testStores(t) {
+		handler := GetAPIHandler(store)
+
+		for _, request := range []struct{ method, path, body string }{
+			{"POST", "/cars", `{"make": "Honda"}`},
+			{"POST", "/cars", `{"make": "Ford"}`},
+			{"PUT", "/cars/car1/status", `{"sold": true}`},
+			{"DELETE", "/cars/car1", ""},
+		} {
+			w := serveAPI(t, handler, request.method, request.path, request.body)
+			if w.Code >= 300 {
+				t.Fatalf("%s: %s %s: unexpected status %d: %s", name, request.method, request.path, w.Code, w.Body)
+			}
+		}
+
+		// The next car must not be given the deleted car's ID, even
+		// though it is no longer the highest.
+		w := serveAPI(t, handler, "POST", "/cars", `{"make": "Toyota"}`)
+		if w.Code != 201 || strings.TrimSpace(w.Body.String()) != `"car2"` {
+			t.Fatalf("%s: expected car2 to be created, got %d: %s", name, w.Code, w.Body)
+		}
+
+		w = serveAPI(t, handler, "GET", "/cars/car1/history", "")
+		if w.Code != 200 {
+			t.Fatalf("%s: expected the deleted car's history, got %d: %s", name, w.Code, w.Body)
+		}
+
+		history, err := store.GetHistory("car1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != 4 {
+			t.Fatalf("%s: expected 4 history entries for car1, got %+v", name, history)
+		}
+		for i, resource := range []string{HistoryCar, HistoryStatus} {
+			h := history[2+i]
+			if h.Resource != resource || h.Revision != 0 || string(h.New) != "null" {
+				t.Errorf("%s: expected the deletion of the %s to be recorded, got %+v", name, resource, h)
+			}
+		}
+	}
+}
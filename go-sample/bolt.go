@@ -0,0 +1,568 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltCarsBucket            = []byte("cars")
+	boltStatusesBucket        = []byte("statuses")
+	boltCarRevisionsBucket    = []byte("car_revisions")
+	boltStatusRevisionsBucket = []byte("status_revisions")
+
+	// The history bucket contains a nested bucket for each car ID, which
+	// holds the car's HistoryEntry values keyed by sequence number.
+	boltHistoryBucket = []byte("history")
+
+	// The meta bucket's sequence number is used as the revision
+	// counter.
+	boltMetaBucket = []byte("meta")
+
+	// boltMigratedKey is set in the meta bucket once the contents of a
+	// data.json file have been imported, so that we never import twice.
+	boltMigratedKey = []byte("migrated-from")
+
+	// boltNextCarNumberKey holds the number of the ID which will next be
+	// allocated to a new car, in the meta bucket.
+	boltNextCarNumberKey = []byte("next-car-number")
+)
+
+// Assert compliance with CarStore
+var _ CarStore = (*BoltStore)(nil)
+
+// BoltStore is a CarStore backed by an embedded bbolt database. Unlike
+// JSONFileStore, every mutation only writes the affected records, and does so
+// inside of a transaction which has been committed to disk by the time the
+// method returns.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens (creating it if needed) the bbolt database "data.db"
+// within the directory dir.
+//
+// If the directory also contains a "data.json" file written by
+// JSONFileStore, and the database has never had data imported into it, the
+// contents of that file are imported, along with any changes in its journal,
+// and it is renamed to "data.json.migrated".
+func NewBoltStore(dir string) (*BoltStore, error) {
+	dinfo, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if !dinfo.IsDir() {
+		return nil, fmt.Errorf("'%s' is not a directory", dir)
+	}
+
+	// The timeout prevents us from hanging forever if another process
+	// is already holding the database open.
+	db, err := bolt.Open(filepath.Join(dir, "data.db"), 0644, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltCarsBucket, boltStatusesBucket, boltCarRevisionsBucket, boltStatusRevisionsBucket, boltHistoryBucket, boltMetaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		// Databases created before revisions were introduced won't
+		// have any, so we assign them here.
+		if err := boltAssignRevisions(tx, boltCarsBucket, boltCarRevisionsBucket); err != nil {
+			return err
+		}
+		if err := boltAssignRevisions(tx, boltStatusesBucket, boltStatusRevisionsBucket); err != nil {
+			return err
+		}
+
+		// Nor will they have a car ID counter, so we make sure it is
+		// past every car with a record or a history.
+		ids := []string{}
+		for _, name := range [][]byte{boltCarsBucket, boltHistoryBucket} {
+			err := tx.Bucket(name).ForEach(func(k, v []byte) error {
+				ids = append(ids, string(k))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return boltUseCarIDs(tx, ids)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &BoltStore{db: db}
+
+	err = s.migrateFromJSON(filepath.Join(dir, "data.json"))
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate from data.json: %w", err)
+	}
+
+	return s, nil
+}
+
+// migrateFromJSON performs the one-shot import of a data.json file, if there
+// is one to import.
+func (s *BoltStore) migrateFromJSON(path string) error {
+	// Changes which JSONFileStore journaled but never compacted would be
+	// lost if only the snapshot were imported, so fold them into it
+	// first, which JSONFileStore does when it is closed.
+	info, err := os.Stat(path + ".journal")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if err == nil && info.Size() > 0 {
+		js, err := NewJSONFileStore(filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+
+		err = js.LoadFromDisk()
+		if err != nil {
+			return err
+		}
+
+		err = js.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	pd := &PersistanceData{}
+	err = json.Unmarshal(raw, pd)
+	if err != nil {
+		return fmt.Errorf("failed to parse '%s': %w", path, err)
+	}
+
+	imported := false
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(boltMetaBucket)
+		if meta.Get(boltMigratedKey) != nil {
+			return nil
+		}
+
+		for id, car := range pd.Cars {
+			if !ValidateID(id) {
+				return fmt.Errorf("invalid car ID '%s'", id)
+			}
+
+			if err := boltPut(tx.Bucket(boltCarsBucket), id, car); err != nil {
+				return err
+			}
+
+			if rev := pd.CarRevisions[id]; rev != 0 {
+				if err := boltPutRevision(tx.Bucket(boltCarRevisionsBucket), id, rev); err != nil {
+					return err
+				}
+			}
+		}
+
+		for id, status := range pd.Statuses {
+			if err := boltPut(tx.Bucket(boltStatusesBucket), id, status); err != nil {
+				return err
+			}
+
+			if rev := pd.StatusRevisions[id]; rev != 0 {
+				if err := boltPutRevision(tx.Bucket(boltStatusRevisionsBucket), id, rev); err != nil {
+					return err
+				}
+			}
+		}
+
+		for id, history := range pd.History {
+			for _, h := range history {
+				if err := boltAppendHistory(tx, id, h); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := boltAdvanceCarNumber(tx, pd.NextCarNumber); err != nil {
+			return err
+		}
+
+		if err := boltUseCarIDs(tx, append(sortedKeys(pd.Cars), sortedKeys(pd.History)...)); err != nil {
+			return err
+		}
+
+		if pd.Revision > meta.Sequence() {
+			if err := meta.SetSequence(pd.Revision); err != nil {
+				return err
+			}
+		}
+
+		if err := boltAssignRevisions(tx, boltCarsBucket, boltCarRevisionsBucket); err != nil {
+			return err
+		}
+
+		if err := boltAssignRevisions(tx, boltStatusesBucket, boltStatusRevisionsBucket); err != nil {
+			return err
+		}
+
+		imported = true
+		return meta.Put(boltMigratedKey, []byte(path))
+	})
+	if err != nil || !imported {
+		return err
+	}
+
+	log.Printf("imported %d cars and %d statuses from '%s'\n", len(pd.Cars), len(pd.Statuses), path)
+
+	// Move the file out of the way, so nobody mistakes it for the live
+	// data. The journal is empty by now, so it is simply removed.
+	err = os.Rename(path, path+".migrated")
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path + ".journal")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// boltPut JSON encodes value and stores it under key in the bucket.
+func boltPut(b *bolt.Bucket, key string, value interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return b.Put([]byte(key), raw)
+}
+
+// boltGet decodes the value stored under key in the bucket into value,
+// returning false if the key did not exist.
+func boltGet(b *bolt.Bucket, key string, value interface{}) (bool, error) {
+	raw := b.Get([]byte(key))
+	if raw == nil {
+		return false, nil
+	}
+
+	return true, json.Unmarshal(raw, value)
+}
+
+// boltGetRevision returns the revision stored under key in the bucket, or 0
+// if there is none.
+func boltGetRevision(b *bolt.Bucket, key string) uint64 {
+	raw := b.Get([]byte(key))
+	if len(raw) != 8 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(raw)
+}
+
+// boltPutRevision stores the revision under key in the bucket.
+func boltPutRevision(b *bolt.Bucket, key string, rev uint64) error {
+	raw := make([]byte, 8)
+	binary.BigEndian.PutUint64(raw, rev)
+	return b.Put([]byte(key), raw)
+}
+
+// boltNextRevision allocates a new revision number.
+func boltNextRevision(tx *bolt.Tx) (uint64, error) {
+	return tx.Bucket(boltMetaBucket).NextSequence()
+}
+
+// boltNextCarNumber returns the number of the ID which will next be
+// allocated to a new car.
+func boltNextCarNumber(tx *bolt.Tx) uint64 {
+	raw := tx.Bucket(boltMetaBucket).Get(boltNextCarNumberKey)
+	if len(raw) != 8 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(raw)
+}
+
+// boltAdvanceCarNumber sets the number of the ID which will next be
+// allocated to a new car, unless the counter is already past it.
+func boltAdvanceCarNumber(tx *bolt.Tx, next uint64) error {
+	if next <= boltNextCarNumber(tx) {
+		return nil
+	}
+
+	raw := make([]byte, 8)
+	binary.BigEndian.PutUint64(raw, next)
+	return tx.Bucket(boltMetaBucket).Put(boltNextCarNumberKey, raw)
+}
+
+// boltUseCarIDs advances the car ID counter past the given IDs, so that
+// NextCarID never returns them.
+func boltUseCarIDs(tx *bolt.Tx, ids []string) error {
+	next, err := nextCarNumber(ids)
+	if err != nil {
+		return err
+	}
+
+	return boltAdvanceCarNumber(tx, next)
+}
+
+// boltAssignRevisions allocates a revision for every record in the data
+// bucket that does not yet have one in the revisions bucket.
+func boltAssignRevisions(tx *bolt.Tx, data, revisions []byte) error {
+	revs := tx.Bucket(revisions)
+	return tx.Bucket(data).ForEach(func(k, v []byte) error {
+		if boltGetRevision(revs, string(k)) != 0 {
+			return nil
+		}
+
+		rev, err := boltNextRevision(tx)
+		if err != nil {
+			return err
+		}
+
+		return boltPutRevision(revs, string(k), rev)
+	})
+}
+
+// boltAppendHistory adds the entry to the end of the car's history.
+func boltAppendHistory(tx *bolt.Tx, id string, h HistoryEntry) error {
+	b, err := tx.Bucket(boltHistoryBucket).CreateBucketIfNotExists([]byte(id))
+	if err != nil {
+		return err
+	}
+
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	// Big endian keys sort in numeric order, so ForEach visits the
+	// entries oldest first.
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+
+	raw, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(key, raw)
+}
+
+// boltPrevious returns the JSON stored under id in the data bucket, or nil
+// if there is none, for use as the previous value of a HistoryEntry.
+func boltPrevious(b *bolt.Bucket, id string) interface{} {
+	raw := b.Get([]byte(id))
+	if raw == nil {
+		return nil
+	}
+
+	return json.RawMessage(raw)
+}
+
+// boltSet stores value under id in the data bucket, after checking the
+// Precondition against its current revision in the revisions bucket, and
+// records the change in the car's history. It returns the previous and new
+// revisions.
+func boltSet(tx *bolt.Tx, data, revisions []byte, resource, id string, value interface{}, pre Precondition, author Author) (uint64, uint64, error) {
+	revs := tx.Bucket(revisions)
+	prev := boltGetRevision(revs, id)
+	if err := pre.check(prev); err != nil {
+		return prev, 0, err
+	}
+
+	rev, err := boltNextRevision(tx)
+	if err != nil {
+		return prev, 0, err
+	}
+
+	h, err := newHistoryEntry(author, resource, rev, boltPrevious(tx.Bucket(data), id), value)
+	if err != nil {
+		return prev, 0, err
+	}
+
+	if err := boltAppendHistory(tx, id, h); err != nil {
+		return prev, 0, err
+	}
+
+	if err := boltPut(tx.Bucket(data), id, value); err != nil {
+		return prev, 0, err
+	}
+
+	return prev, rev, boltPutRevision(revs, id, rev)
+}
+
+// Close closes the underlying database.
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// GetCarIDs implements CarStore.GetCarIDs.
+func (s *BoltStore) GetCarIDs() ([]string, error) {
+	ids := []string{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltCarsBucket).ForEach(func(k, v []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+	})
+	return ids, err
+}
+
+// GetCar implements CarStore.GetCar.
+func (s *BoltStore) GetCar(id string) (Car, uint64, error) {
+	car := Car{}
+	var rev uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		ok, err := boltGet(tx.Bucket(boltCarsBucket), id, &car)
+		if ok {
+			rev = boltGetRevision(tx.Bucket(boltCarRevisionsBucket), id)
+		}
+		return err
+	})
+	return car, rev, err
+}
+
+// SetCar implements CarStore.SetCar.
+func (s *BoltStore) SetCar(id string, car Car, pre Precondition, author Author) (uint64, uint64, error) {
+	if !ValidateID(id) {
+		// This should never happen, since the caller is supposed to
+		// validate the ID.
+		return 0, 0, fmt.Errorf("invalid ID passed to SetCar: '%s'", id)
+	}
+
+	var prev, rev uint64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		prev, rev, err = boltSet(tx, boltCarsBucket, boltCarRevisionsBucket, HistoryCar, id, car, pre, author)
+		if err != nil {
+			return err
+		}
+
+		return boltUseCarIDs(tx, []string{id})
+	})
+	return prev, rev, err
+}
+
+// DeleteCar implements CarStore.DeleteCar.
+func (s *BoltStore) DeleteCar(id string, pre Precondition, author Author) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := pre.check(boltGetRevision(tx.Bucket(boltCarRevisionsBucket), id))
+		if err != nil {
+			return err
+		}
+
+		deleted := []struct {
+			resource string
+			bucket   []byte
+		}{
+			{HistoryCar, boltCarsBucket},
+			{HistoryStatus, boltStatusesBucket},
+		}
+		for _, d := range deleted {
+			previous := boltPrevious(tx.Bucket(d.bucket), id)
+			if previous == nil {
+				continue
+			}
+
+			h, err := newHistoryEntry(author, d.resource, 0, previous, nil)
+			if err != nil {
+				return err
+			}
+
+			if err := boltAppendHistory(tx, id, h); err != nil {
+				return err
+			}
+		}
+
+		for _, name := range [][]byte{boltCarsBucket, boltStatusesBucket, boltCarRevisionsBucket, boltStatusRevisionsBucket} {
+			if err := tx.Bucket(name).Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SetStatus implements CarStore.SetStatus.
+func (s *BoltStore) SetStatus(id string, status Status, pre Precondition, author Author) (uint64, uint64, error) {
+	var prev, rev uint64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltCarsBucket).Get([]byte(id)) == nil {
+			return fmt.Errorf("cannot set status of car '%s': %w", id, ErrCarNotFound)
+		}
+
+		var err error
+		prev, rev, err = boltSet(tx, boltStatusesBucket, boltStatusRevisionsBucket, HistoryStatus, id, status, pre, author)
+		return err
+	})
+	return prev, rev, err
+}
+
+// GetStatus implements CarStore.GetStatus.
+func (s *BoltStore) GetStatus(id string) (Status, uint64, error) {
+	status := Status{}
+	var rev uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		ok, err := boltGet(tx.Bucket(boltStatusesBucket), id, &status)
+		if ok {
+			rev = boltGetRevision(tx.Bucket(boltStatusRevisionsBucket), id)
+		}
+		return err
+	})
+	return status, rev, err
+}
+
+// GetHistory implements CarStore.GetHistory.
+func (s *BoltStore) GetHistory(id string) ([]HistoryEntry, error) {
+	history := []HistoryEntry{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltHistoryBucket).Bucket([]byte(id))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			h := HistoryEntry{}
+			if err := json.Unmarshal(v, &h); err != nil {
+				return err
+			}
+			history = append(history, h)
+			return nil
+		})
+	})
+	return history, err
+}
+
+// NextCarID implements CarStore.NextCarID.
+func (s *BoltStore) NextCarID() (string, error) {
+	var next uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		next = boltNextCarNumber(tx)
+		return nil
+	})
+	return fmt.Sprintf("car%d", next), err
+}
@@ -0,0 +1,113 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBoltStoreMigratesJournal(t *testing.T) {
+	dir := t.TempDir()
+	author := Author{Subject: "alice"}
+
+	// Leave changes both in the snapshot and only in the journal.
+	js := loadJSONFileStore(t, dir)
+	_, _, err := js.SetCar("car0", Car{Make: "Honda"}, nil, author)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = js.SaveToDisk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = js.SetCar("car1", Car{Make: "Ford"}, nil, author)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = js.SetStatus("car0", Status{Sold: true}, nil, author)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash(t, js)
+
+	s, err := NewBoltStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for id, make := range map[string]string{"car0": "Honda", "car1": "Ford"} {
+		car, rev, err := s.GetCar(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if car.Make != make || rev == 0 {
+			t.Errorf("expected %s to be a %s, got %+v at revision %d", id, make, car, rev)
+		}
+	}
+
+	status, _, err := s.GetStatus("car0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Sold {
+		t.Errorf("journaled status of car0 was not imported")
+	}
+
+	history, err := s.GetHistory("car0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 {
+		t.Errorf("expected 2 history entries for car0, got %d", len(history))
+	}
+
+	for _, name := range []string{"data.json", "data.json.journal"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected %s to have been moved out of the way, got %v", name, err)
+		}
+	}
+}
+
+func TestBoltStoreNeverReusesCarIDs(t *testing.T) {
+	dir := t.TempDir()
+	author := Author{Subject: "alice"}
+
+	s, err := NewBoltStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"car0", "car1"} {
+		_, _, err := s.SetCar(id, Car{Make: "Honda"}, nil, author)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = s.DeleteCar("car1", nil, author)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewBoltStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	id, err := s.NextCarID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "car2" {
+		t.Errorf("expected car2, got %s", id)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned by an OPADecider whose circuit breaker is open,
+// meaning that OPA has failed repeatedly and is not currently being asked for
+// decisions.
+var ErrCircuitOpen = errors.New("circuit breaker is open, OPA is unavailable")
+
+// Circuit breaker states.
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// circuitBreaker keeps track of failures talking to OPA. Once threshold
+// consecutive failures have occurred it opens, and requests fail fast until
+// cooldown has passed. It then lets a single trial request through, which
+// closes it again if it succeeds, or re-opens it if it fails.
+//
+// A threshold of 0 disables the breaker, so that it never opens, but it still
+// keeps track of failures for reporting.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mutex     sync.Mutex
+	state     string
+	failures  int
+	openedAt  time.Time
+	lastError error
+
+	// trial is true while the single request allowed through in the
+	// half-open state is in flight.
+	trial bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     circuitClosed,
+	}
+}
+
+// allow returns true if a request may be made. If it returns true, the
+// caller must later call exactly one of success, failure or abandon.
+func (b *circuitBreaker) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = circuitHalfOpen
+		b.trial = true
+		return true
+
+	case circuitHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	}
+
+	return true
+}
+
+// success records that OPA answered the request.
+func (b *circuitBreaker) success() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.state = circuitClosed
+	b.failures = 0
+	b.lastError = nil
+	b.trial = false
+}
+
+// failure records that OPA failed to answer the request.
+func (b *circuitBreaker) failure(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures++
+	b.lastError = err
+	b.trial = false
+
+	if b.threshold > 0 && (b.state == circuitHalfOpen || b.failures >= b.threshold) {
+		b.state = circuitOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// abandon records that the request was given up on for reasons that say
+// nothing about OPA, e.g. because the client went away.
+func (b *circuitBreaker) abandon() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.trial = false
+}
+
+// health reports the state of the breaker.
+func (b *circuitBreaker) health() DeciderHealth {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	h := DeciderHealth{
+		Healthy:             b.failures == 0,
+		State:               b.state,
+		ConsecutiveFailures: b.failures,
+	}
+
+	if b.lastError != nil {
+		h.LastError = b.lastError.Error()
+	}
+
+	if b.state != circuitClosed {
+		openedAt := b.openedAt
+		h.OpenedAt = &openedAt
+	}
+
+	return h
+}
+
+// DeciderHealth describes the health of the OPA used by an OPADecider.
+type DeciderHealth struct {
+	// Healthy is true if the most recent decision succeeded.
+	Healthy bool `json:"healthy"`
+
+	// State is the state of the circuit breaker, one of "closed",
+	// "open" or "half-open".
+	State string `json:"state"`
+
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastError           string     `json:"last_error,omitempty"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+}
+
+// HealthReporter is implemented by OPADeciders which can report on the
+// health of the OPA they use.
+type HealthReporter interface {
+	Health() DeciderHealth
+}
+
+// GetHealthHandler returns a handler which reports the health of the OPA
+// used by the decider as JSON, responding with 503 if it is unhealthy.
+func GetHealthHandler(reporter HealthReporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		health := reporter.Health()
+
+		w.Header().Add("Content-Type", "application/json")
+		if !health.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(health)
+	})
+}
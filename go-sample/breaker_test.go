@@ -0,0 +1,184 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// expectState checks the state the breaker reports.
+func expectState(t *testing.T, b *circuitBreaker, state string, failures int) {
+	t.Helper()
+
+	h := b.health()
+	if h.State != state || h.ConsecutiveFailures != failures {
+		t.Errorf("expected state %s with %d failures, got %s with %d", state, failures, h.State, h.ConsecutiveFailures)
+	}
+}
+
+// cooledDown makes the breaker's cooldown pass without waiting for it.
+func cooledDown(b *circuitBreaker) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.openedAt = time.Now().Add(-b.cooldown)
+}
+
+func TestCircuitBreakerOpensAfterThreshold(t *testing.T) {
+	b := newCircuitBreaker(3, time.Hour)
+	failed := errors.New("connection refused")
+
+	for i := 1; i < 3; i++ {
+		if !b.allow() {
+			t.Fatalf("breaker opened after %d failures", i-1)
+		}
+		b.failure(failed)
+		expectState(t, b, circuitClosed, i)
+	}
+
+	// A success resets the count of consecutive failures.
+	b.allow()
+	b.success()
+	expectState(t, b, circuitClosed, 0)
+
+	for i := 0; i < 3; i++ {
+		b.allow()
+		b.failure(failed)
+	}
+	expectState(t, b, circuitOpen, 3)
+
+	if b.allow() {
+		t.Error("open breaker allowed a request before the cooldown passed")
+	}
+
+	h := b.health()
+	if h.Healthy || h.LastError != failed.Error() || h.OpenedAt == nil {
+		t.Errorf("unexpected health %+v", h)
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	b := newCircuitBreaker(1, time.Hour)
+	failed := errors.New("connection refused")
+
+	b.allow()
+	b.failure(failed)
+	expectState(t, b, circuitOpen, 1)
+
+	// Once the cooldown has passed, a single trial request is allowed.
+	cooledDown(b)
+	if !b.allow() {
+		t.Fatal("breaker did not allow a trial request after the cooldown")
+	}
+	expectState(t, b, circuitHalfOpen, 1)
+	if b.allow() {
+		t.Error("breaker allowed a second request while the trial was in flight")
+	}
+
+	// A failed trial re-opens the breaker, for another cooldown.
+	b.failure(failed)
+	expectState(t, b, circuitOpen, 2)
+	if b.allow() {
+		t.Error("breaker allowed a request straight after the trial failed")
+	}
+
+	// An abandoned trial says nothing about OPA, so another is allowed.
+	cooledDown(b)
+	if !b.allow() {
+		t.Fatal("breaker did not allow a trial request after the cooldown")
+	}
+	b.abandon()
+	expectState(t, b, circuitHalfOpen, 2)
+	if !b.allow() {
+		t.Fatal("breaker did not allow a trial request after one was abandoned")
+	}
+
+	// A successful trial closes the breaker.
+	b.success()
+	expectState(t, b, circuitClosed, 0)
+	if !b.allow() || !b.allow() {
+		t.Error("closed breaker did not allow requests")
+	}
+	if h := b.health(); !h.Healthy || h.LastError != "" || h.OpenedAt != nil {
+		t.Errorf("unexpected health %+v", h)
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	b := newCircuitBreaker(0, 0)
+
+	for i := 1; i <= 10; i++ {
+		if !b.allow() {
+			t.Fatalf("disabled breaker refused a request after %d failures", i-1)
+		}
+		b.failure(errors.New("connection refused"))
+	}
+
+	expectState(t, b, circuitClosed, 10)
+	if b.health().Healthy {
+		t.Error("expected the failures to be reported")
+	}
+}
+
+func TestHTTPDeciderCircuitBreaker(t *testing.T) {
+	var requests int32
+	var healthy atomic.Value
+	healthy.Store(false)
+
+	opa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if !healthy.Load().(bool) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"decision_id": "d1", "result": {"allow": true}}`))
+	}))
+	defer opa.Close()
+
+	for _, fallback := range []*OPADecision{nil, {ID: "fallback"}} {
+		healthy.Store(false)
+		atomic.StoreInt32(&requests, 0)
+
+		d := NewHTTPDecider(opa.URL, WithCircuitBreaker(2, time.Hour, fallback)).(*HTTPDecider)
+		ctx := context.Background()
+
+		for i := 0; i < 2; i++ {
+			if _, err := d.Decision(ctx, nil); err == nil {
+				t.Fatal("expected the decision to fail")
+			}
+		}
+
+		// The breaker is open, so OPA is no longer asked.
+		decision, err := d.Decision(ctx, nil)
+		if fallback == nil && !errors.Is(err, ErrCircuitOpen) {
+			t.Errorf("failing closed: expected ErrCircuitOpen, got %v, %v", decision, err)
+		} else if fallback != nil && (err != nil || decision.ID != fallback.ID || !decision.Fallback) {
+			t.Errorf("failing open: expected the fallback decision, got %v, %v", decision, err)
+		}
+		if n := atomic.LoadInt32(&requests); n != 2 {
+			t.Errorf("expected OPA to be asked twice, got %d", n)
+		}
+		if h := d.Health(); h.State != circuitOpen {
+			t.Errorf("expected the breaker to be open, got %+v", h)
+		}
+
+		// Once OPA recovers, the trial request closes the breaker.
+		healthy.Store(true)
+		cooledDown(d.breaker)
+		decision, err = d.Decision(ctx, nil)
+		if err != nil || decision.ID != "d1" {
+			t.Errorf("expected OPA's decision after the cooldown, got %v, %v", decision, err)
+		}
+		if h := d.Health(); h.State != circuitClosed || !h.Healthy {
+			t.Errorf("expected the breaker to be closed, got %+v", h)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/opa/plugins/bundle"
+	"github.com/open-policy-agent/opa/sdk"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Assert compliance with OPADecider and BatchOPADecider
+var _ OPADecider = (*CachingDecider)(nil)
+var _ BatchOPADecider = (*CachingDecider)(nil)
+
+// CachingDecider wraps another OPADecider, and remembers the decisions it
+// returns for a while, so that repeated requests with the same input do not
+// each require a full evaluation. Cached decisions keep the ID of the
+// decision they were originally obtained by, and are returned with Cached
+// set, so that they can be told apart in logs. Fallback decisions, which only
+// stand in for the policy while OPA is unavailable, are not cached.
+//
+// Inputs are compared without the request headers listed in
+// volatileHeaders, so policies must not depend on those headers.
+//
+// Since the policy may change at any time, the cache should be flushed when
+// it does. For the SDK, FlushOnBundleUpdate() arranges this automatically.
+type CachingDecider struct {
+	decider OPADecider
+	ttl     time.Duration
+	size    int
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+
+	// lru orders the entries from most to least recently used. Each
+	// element is a *cacheEntry.
+	lru *list.List
+
+	// generation is incremented by every Flush. Decisions which were
+	// requested from the wrapped decider before a flush are not stored,
+	// since they may have been made by the old policy.
+	generation uint64
+
+	stats CacheStats
+}
+
+// cacheEntry is a single cached decision.
+type cacheEntry struct {
+	key      string
+	decision *OPADecision
+	expires  time.Time
+}
+
+// CacheStats counts the events of a CachingDecider.
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Flushes   uint64 `json:"flushes"`
+	Entries   int    `json:"entries"`
+}
+
+// NewCachingDecider instances an OPADecider which caches the decisions of
+// the given decider for up to ttl. At most size decisions are cached at once,
+// beyond which the least recently used are evicted.
+func NewCachingDecider(decider OPADecider, ttl time.Duration, size int) *CachingDecider {
+	return &CachingDecider{
+		decider: decider,
+		ttl:     ttl,
+		size:    size,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// volatileHeaders are request headers which differ from one request to the
+// next, such as tracing headers, or which policies have no business looking
+// at. They are left out of cache keys, since otherwise hardly any two
+// requests would share a key.
+var volatileHeaders = []string{
+	"Baggage",
+	"Connection",
+	"Content-Length",
+	"Traceparent",
+	"Tracestate",
+	"User-Agent",
+	"X-Request-Id",
+}
+
+// stripVolatileHeaders removes the volatileHeaders from the context.headers
+// of a generic input, such as an EntitlementsInput decoded from JSON.
+func stripVolatileHeaders(generic interface{}) {
+	input, ok := generic.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	entzContext, ok := input["context"].(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	headers, ok := entzContext["headers"].(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	for name := range headers {
+		for _, volatile := range volatileHeaders {
+			if http.CanonicalHeaderKey(name) == volatile {
+				delete(headers, name)
+			}
+		}
+	}
+}
+
+// cacheKey returns a canonical hash of the input, without its
+// volatileHeaders. The input is re-encoded via a generic value so that, for
+// example, a struct and a map with the same fields have the same key.
+// encoding/json sorts object keys, so the encoding does not depend on map
+// iteration order.
+func cacheKey(input interface{}) (string, error) {
+	raw, err := json.Marshal(input)
+	if err != nil {
+		return "", err
+	}
+
+	var generic interface{}
+	err = json.Unmarshal(raw, &generic)
+	if err != nil {
+		return "", err
+	}
+	stripVolatileHeaders(generic)
+
+	canonical, err := json.Marshal(generic)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// lookup returns the cached decision for the key, or nil if there is none,
+// along with the current generation of the cache.
+func (c *CachingDecider) lookup(key string) (*OPADecision, uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		cacheLookups.WithLabelValues("miss").Inc()
+		return nil, c.generation
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		c.stats.Misses++
+		cacheLookups.WithLabelValues("miss").Inc()
+		return nil, c.generation
+	}
+
+	c.lru.MoveToFront(elem)
+	c.stats.Hits++
+	cacheLookups.WithLabelValues("hit").Inc()
+
+	// The cached decision is shared, so it is not modified in place.
+	copied := *entry.decision
+	copied.Cached = true
+	return &copied, c.generation
+}
+
+// store caches the decision under the key, evicting the least recently used
+// decisions if the cache is full. Fallback decisions are not stored, since
+// they would otherwise outlive OPA's recovery, and neither are decisions
+// requested before the cache was last flushed, in the given generation.
+func (c *CachingDecider) store(key string, decision *OPADecision, generation uint64) {
+	if decision.Fallback {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	entry := &cacheEntry{
+		key:      key,
+		decision: decision,
+		expires:  time.Now().Add(c.ttl),
+	}
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+		c.stats.Evictions++
+	}
+}
+
+// Decision implements OPADecider.Decision.
+func (c *CachingDecider) Decision(ctx context.Context, input interface{}) (decision *OPADecision, err error) {
+	ctx, span := startDecisionSpan(ctx, "cache")
+	defer func() { endDecisionSpan(span, decision, err) }()
+
+	key, err := cacheKey(input)
+	if err != nil {
+		return nil, err
+	}
+
+	decision, generation := c.lookup(key)
+	if decision != nil {
+		span.SetAttributes(attribute.Bool("cache.hit", true))
+		return decision, nil
+	}
+	span.SetAttributes(attribute.Bool("cache.hit", false))
+
+	decision, err = c.decider.Decision(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	c.store(key, decision, generation)
+	return decision, nil
+}
+
+// Decisions implements BatchOPADecider.Decisions. Only the inputs which are
+// not cached are passed on to the wrapped decider.
+func (c *CachingDecider) Decisions(ctx context.Context, inputs []interface{}) ([]*OPADecision, error) {
+	decisions := make([]*OPADecision, len(inputs))
+	keys := make([]string, len(inputs))
+
+	missing := []interface{}{}
+	missingIndexes := []int{}
+	var generation uint64
+	for i, input := range inputs {
+		key, err := cacheKey(input)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = key
+
+		// Only the generation of the last lookup matters: if the
+		// cache was flushed in between, nothing will be stored.
+		decisions[i], generation = c.lookup(key)
+		if decisions[i] == nil {
+			missing = append(missing, input)
+			missingIndexes = append(missingIndexes, i)
+		}
+	}
+
+	if len(missing) == 0 {
+		return decisions, nil
+	}
+
+	fetched, err := Decisions(ctx, c.decider, missing)
+	if err != nil {
+		return nil, err
+	}
+
+	for j, i := range missingIndexes {
+		decisions[i] = fetched[j]
+		c.store(keys[i], fetched[j], generation)
+	}
+
+	return decisions, nil
+}
+
+// Flush discards every cached decision.
+func (c *CachingDecider) Flush() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+	c.generation++
+	c.stats.Flushes++
+}
+
+// Stats returns the CachingDecider's counters.
+func (c *CachingDecider) Stats() CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	return stats
+}
+
+// FlushOnBundleUpdate registers a listener with the bundle plugin of the
+// given OPA, which flushes the cache whenever a new bundle is activated. It
+// does nothing if OPA is not configured to download bundles.
+func (c *CachingDecider) FlushOnBundleUpdate(opa *sdk.OPA) {
+	b, ok := opa.Plugin("bundle").(*bundle.Plugin)
+	if !ok {
+		return
+	}
+
+	// NOTE: these variables carry state across calls to the below
+	// callback, which the bundle plugin may make concurrently.
+	var mutex sync.Mutex
+	lastActivation := time.Now()
+
+	b.Register("decision_cache", func(status bundle.Status) {
+		mutex.Lock()
+		activated := status.LastSuccessfulActivation.After(lastActivation)
+		if activated {
+			lastActivation = status.LastSuccessfulActivation
+		}
+		mutex.Unlock()
+
+		if activated {
+			log.Printf("bundle '%s' activated, flushing decision cache\n", status.Name)
+			c.Flush()
+		}
+	})
+}
@@ -0,0 +1,169 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCachingDeciderSkipsFallbackDecisions(t *testing.T) {
+	var healthy atomic.Value
+	healthy.Store(false)
+
+	opa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load().(bool) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"decision_id": "d1", "result": {"allow": true}}`))
+	}))
+	defer opa.Close()
+
+	d := NewHTTPDecider(opa.URL, WithCircuitBreaker(1, time.Hour, &OPADecision{ID: "fail-open"})).(*HTTPDecider)
+	c := NewCachingDecider(d, time.Hour, 10)
+	ctx := context.Background()
+	input := map[string]interface{}{"subject": "alice"}
+
+	if _, err := c.Decision(ctx, input); err == nil {
+		t.Fatal("expected the decision to fail")
+	}
+
+	for i := 0; i < 2; i++ {
+		decision, err := c.Decision(ctx, input)
+		if err != nil || decision.ID != "fail-open" || !decision.Fallback {
+			t.Fatalf("expected the fallback decision, got %v, %v", decision, err)
+		}
+	}
+	if stats := c.Stats(); stats.Entries != 0 || stats.Hits != 0 {
+		t.Errorf("expected the fallback decision not to be cached, got %+v", stats)
+	}
+
+	// Once OPA recovers, its decision is used, and cached.
+	healthy.Store(true)
+	cooledDown(d.breaker)
+	for i := 0; i < 2; i++ {
+		decision, err := c.Decision(ctx, input)
+		if err != nil || decision.ID != "d1" {
+			t.Fatalf("expected OPA's decision after it recovered, got %v, %v", decision, err)
+		}
+	}
+	if stats := c.Stats(); stats.Entries != 1 || stats.Hits != 1 {
+		t.Errorf("expected OPA's decision to be cached, got %+v", stats)
+	}
+}
+
+// deciderFunc adapts a function to an OPADecider.
+type deciderFunc func(ctx context.Context, input interface{}) (*OPADecision, error)
+
+func (f deciderFunc) Decision(ctx context.Context, input interface{}) (*OPADecision, error) {
+	return f(ctx, input)
+}
+
+func TestCachingDeciderDropsDecisionsFromBeforeFlush(t *testing.T) {
+	var c *CachingDecider
+	var evaluations int32
+	c = NewCachingDecider(deciderFunc(func(ctx context.Context, input interface{}) (*OPADecision, error) {
+		// The first evaluation races with a bundle activation, so
+		// may have been made by the old policy.
+		if atomic.AddInt32(&evaluations, 1) == 1 {
+			c.Flush()
+		}
+		return &OPADecision{ID: "d1"}, nil
+	}), time.Hour, 10)
+	ctx := context.Background()
+
+	for _, decide := range []func(input interface{}) error{
+		func(input interface{}) error {
+			_, err := c.Decision(ctx, input)
+			return err
+		},
+		func(input interface{}) error {
+			_, err := c.Decisions(ctx, []interface{}{input})
+			return err
+		},
+	} {
+		atomic.StoreInt32(&evaluations, 0)
+
+		if err := decide("alice"); err != nil {
+			t.Fatal(err)
+		}
+		if stats := c.Stats(); stats.Entries != 0 {
+			t.Errorf("expected the decision made before the flush not to be cached, got %+v", stats)
+		}
+
+		if err := decide("alice"); err != nil {
+			t.Fatal(err)
+		}
+		if stats := c.Stats(); stats.Entries != 1 {
+			t.Errorf("expected the decision made after the flush to be cached, got %+v", stats)
+		}
+
+		c.Flush()
+	}
+}
+
+func TestCacheKeyIgnoresVolatileHeaders(t *testing.T) {
+	request := func(headers http.Header) *EntitlementsInput {
+		return &EntitlementsInput{
+			Action:   "GET",
+			Resource: "/cars",
+			Subject:  "alice",
+			Context:  map[string]interface{}{"headers": headers},
+		}
+	}
+
+	base, err := cacheKey(request(http.Header{
+		"Authorization": {"Bearer a"},
+		"User-Agent":    {"curl/7.81.0"},
+		"Traceparent":   {"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	same, err := cacheKey(request(http.Header{
+		"Authorization": {"Bearer a"},
+		"User-Agent":    {"Mozilla/5.0"},
+		"Traceparent":   {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		"X-Request-Id":  {"42"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same != base {
+		t.Error("expected inputs which differ only in volatile headers to share a key")
+	}
+
+	different, err := cacheKey(request(http.Header{
+		"Authorization": {"Bearer b"},
+		"User-Agent":    {"curl/7.81.0"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if different == base {
+		t.Error("expected inputs with different Authorization headers to have different keys")
+	}
+}
+
+func TestCachingDeciderMarksCachedDecisions(t *testing.T) {
+	c := NewCachingDecider(NewDummyDecider(&OPADecision{ID: "d1"}), time.Hour, 10)
+	ctx := context.Background()
+
+	for i, cached := range []bool{false, true, true} {
+		decision, err := c.Decision(ctx, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decision.ID != "d1" || decision.Cached != cached {
+			t.Errorf("decision %d: expected d1 with cached %v, got %+v", i, cached, decision)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/alecthomas/kong"
+	"gopkg.in/yaml.v3"
+
+	"github.com/styrainc/entitlements-samples/go-sample"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+//
+// This file deals with where carinfoserver's settings come from. Each flag
+// may also be set by an environment variable, named after the flag with a
+// CARINFOSERVER_ prefix, or in a config file given by --config-file. Flags
+// take precedence over environment variables, which take precedence over the
+// config file, which takes precedence over the defaults.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// envPrefix prefixes the names of the environment variables which set flags,
+// e.g. CARINFOSERVER_OPA_RETRIES sets --opa-retries.
+const envPrefix = "CARINFOSERVER"
+
+// exitInvalidConfig is the status carinfoserver exits with if its settings
+// are invalid, whether kong rejects them or validateConfig does.
+const exitInvalidConfig = 2
+
+// configFile is a kong.Resolver which takes the values of flags from a YAML
+// or TOML file, whose keys are the long names of the flags, e.g.
+//
+//	mode: [sdk, deny-all]
+//	opa-retries: 3
+//
+// Underscores may be used in place of hyphens, which is more natural in TOML.
+type configFile struct {
+	path   string
+	values map[string]interface{}
+}
+
+// Assert compliance with kong.Resolver
+var _ kong.Resolver = (*configFile)(nil)
+
+// loadConfigFile reads the config file at path, whose format is given by its
+// extension.
+func loadConfigFile(path string) (*configFile, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(raw, &values)
+	case ".toml":
+		err = toml.Unmarshal(raw, &values)
+	default:
+		return nil, fmt.Errorf("config file '%s' is not a .yaml, .yml or .toml file", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file '%s': %w", path, err)
+	}
+
+	c := &configFile{path: path, values: map[string]interface{}{}}
+	for key, value := range values {
+		c.values[strings.ReplaceAll(key, "_", "-")] = value
+	}
+
+	return c, nil
+}
+
+// Validate implements kong.Resolver.Validate. It rejects settings which do
+// not correspond to a flag, so that typos are not silently ignored.
+func (c *configFile) Validate(app *kong.Application) error {
+	known := map[string]bool{}
+	for _, flag := range app.Flags {
+		known[flag.Name] = true
+	}
+
+	// Config files may not refer to one another.
+	delete(known, "config-file")
+	delete(known, "help")
+
+	unknown := []string{}
+	for key := range c.values {
+		if !known[key] {
+			unknown = append(unknown, "'"+key+"'")
+		}
+	}
+	sort.Strings(unknown)
+
+	if len(unknown) > 0 {
+		return fmt.Errorf("config file '%s' has unknown settings %s", c.path, strings.Join(unknown, ", "))
+	}
+
+	return nil
+}
+
+// Resolve implements kong.Resolver.Resolve. Values are given to kong as
+// strings, so that they are parsed just as they would be on the command line,
+// whatever type the file gave them.
+func (c *configFile) Resolve(context *kong.Context, parent *kong.Path, flag *kong.Flag) (interface{}, error) {
+	switch value := c.values[flag.Name].(type) {
+	case nil:
+		return nil, nil
+
+	case []interface{}:
+		values := []interface{}{}
+		for _, v := range value {
+			values = append(values, fmt.Sprint(v))
+		}
+		return values, nil
+
+	case map[string]interface{}:
+		return nil, fmt.Errorf("config file '%s' must give a value or a list of values", c.path)
+
+	default:
+		return fmt.Sprint(value), nil
+	}
+}
+
+// envResolver takes the values of flags from their environment variables.
+// kong itself applies these before any resolvers, so the config file would
+// override them; resolving them again afterwards gives them precedence over
+// it.
+var envResolver kong.ResolverFunc = func(context *kong.Context, parent *kong.Path, flag *kong.Flag) (interface{}, error) {
+	if flag.Env == "" {
+		return nil, nil
+	}
+
+	if value := os.Getenv(flag.Env); value != "" {
+		return value, nil
+	}
+
+	return nil, nil
+}
+
+// parseCLI parses the flags into CLI, along with any environment variables
+// and config file, and returns the resulting context. The command line is
+// parsed once to find the config file, and again with the config file
+// loaded, exiting if either fails.
+func parseCLI() *kong.Context {
+	options := []kong.Option{
+		kong.Description("Serves the CarInfoStore API, checking each request against an Entitlements policy."),
+		kong.DefaultEnvars(envPrefix),
+		kong.Resolvers(envResolver),
+		kong.Exit(func(code int) {
+			if code != 0 {
+				code = exitInvalidConfig
+			}
+			os.Exit(code)
+		}),
+	}
+
+	parser := kong.Must(&CLI, options...)
+	ctx, err := parser.Parse(os.Args[1:])
+	parser.FatalIfErrorf(err)
+
+	if CLI.ConfigFile == "" {
+		return ctx
+	}
+
+	file, err := loadConfigFile(CLI.ConfigFile)
+	parser.FatalIfErrorf(err)
+
+	// The config file's resolver must come before envResolver, since
+	// kong uses the value from the last resolver which gives one.
+	parser = kong.Must(&CLI, append([]kong.Option{kong.Resolvers(file)}, options...)...)
+	ctx, err = parser.Parse(os.Args[1:])
+	parser.FatalIfErrorf(err)
+
+	return ctx
+}
+
+// validateConfig checks the settings for errors which would stop the server
+// from starting, and returns all of them. The files which the server reads
+// when it starts, such as credentials and certificates, are read, but the
+// embedded OPA is not started, the store is not opened and nothing listens.
+func validateConfig() []error {
+	errs := []error{}
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if CLI.Port <= 0 || CLI.Port > 65535 {
+		check(fmt.Errorf("port %d is out of range", CLI.Port))
+	}
+
+	if CLI.AdminPort < 0 || CLI.AdminPort > 65535 {
+		check(fmt.Errorf("admin-port %d is out of range", CLI.AdminPort))
+	} else if CLI.AdminPort == CLI.Port {
+		check(fmt.Errorf("admin-port must differ from port"))
+	}
+
+	if info, err := os.Stat(CLI.Storage); err != nil {
+		check(err)
+	} else if !info.IsDir() {
+		check(fmt.Errorf("'%s' is not a directory", CLI.Storage))
+	}
+
+	if CLI.Backend == "json" && CLI.Compact <= 0 {
+		check(fmt.Errorf("compact-interval must be positive"))
+	}
+
+	_, err := sample.ParseResultPath(CLI.Allow)
+	check(err)
+
+	if len(CLI.Mode) == 0 {
+		check(fmt.Errorf("at least one mode must be given"))
+	}
+
+	modes := map[string]bool{}
+	for _, mode := range CLI.Mode {
+		if modes[mode] {
+			check(fmt.Errorf("mode '%s' given more than once", mode))
+			continue
+		}
+		modes[mode] = true
+
+		switch mode {
+		case "sdk":
+			if CLI.Config == "" {
+				check(fmt.Errorf("config must be provided in sdk mode"))
+			} else if _, err := os.Stat(CLI.Config); err != nil {
+				check(err)
+			}
+
+			if CLI.Rule == "" {
+				check(fmt.Errorf("rule must be provided in sdk mode"))
+			}
+
+		case "http":
+			if CLI.OPA == "" {
+				check(fmt.Errorf("opa must be provided in http mode"))
+			}
+
+		case "allow-all", "deny-all":
+
+		default:
+			check(fmt.Errorf("mode '%s' is not one of sdk, http, allow-all, deny-all", mode))
+		}
+	}
+
+	if CLI.ShadowRule != "" && CLI.ShadowOPA != "" {
+		check(fmt.Errorf("only one of shadow-rule and shadow-opa may be given"))
+	} else if CLI.ShadowRule != "" && !modes["sdk"] {
+		check(fmt.Errorf("shadow-rule requires sdk mode"))
+	}
+
+	if CLI.Playground && !modes["sdk"] {
+		check(fmt.Errorf("entz-playground can only be enabled in sdk mode"))
+	}
+
+	for _, setting := range []struct {
+		name  string
+		value int64
+	}{
+		{"opa-retries", int64(CLI.Retries)},
+		{"opa-retry-backoff", int64(CLI.Backoff)},
+		{"opa-breaker-threshold", int64(CLI.Threshold)},
+		{"opa-breaker-cooldown", int64(CLI.Cooldown)},
+		{"decision-timeout", int64(CLI.Timeout)},
+		{"shutdown-timeout", int64(CLI.Drain)},
+		{"cache-ttl", int64(CLI.CacheTTL)},
+		{"decision-log-max-files", int64(CLI.DecLogKeep)},
+	} {
+		if setting.value < 0 {
+			check(fmt.Errorf("%s must not be negative", setting.name))
+		}
+	}
+
+	if CLI.CacheTTL > 0 && CLI.CacheSize <= 0 {
+		check(fmt.Errorf("cache-size must be positive when cache-ttl is given"))
+	}
+
+	if CLI.BodyLimit <= 0 {
+		check(fmt.Errorf("body-limit must be positive"))
+	}
+
+	if CLI.DecLogSize <= 0 {
+		check(fmt.Errorf("decision-log-max-size must be positive"))
+	}
+
+	_, err = sample.ParseRouteTemplates(CLI.BodyOn)
+	check(err)
+
+	_, err = sample.ParseRouteTemplates(CLI.MonitorOn)
+	check(err)
+
+	for _, mask := range CLI.DecLogMask {
+		_, err := sample.ParseResultPath(mask)
+		check(err)
+	}
+
+	names := subjectResolverNames()
+	check(checkSubjectResolverNames(names))
+	for _, name := range names {
+		_, err := newSubjectResolver(name)
+		check(err)
+	}
+
+	if CLI.TLSCert != "" || CLI.TLSKey != "" {
+		_, err := tls.LoadX509KeyPair(CLI.TLSCert, CLI.TLSKey)
+		check(err)
+
+		_, err = newTLSConfig()
+		check(err)
+	} else if CLI.TLSCA != "" {
+		check(fmt.Errorf("tls-client-ca requires tls-cert and tls-key"))
+	}
+
+	if CLI.TraceRatio < 0 || CLI.TraceRatio > 1 {
+		check(fmt.Errorf("trace-sample-ratio must be between 0 and 1"))
+	}
+
+	return errs
+}
+
+// reportConfigErrors prints each of the errors found by validateConfig.
+func reportConfigErrors(errs []error) {
+	fmt.Fprintf(os.Stderr, "carinfoserver: invalid configuration:\n")
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "  - %v\n", err)
+	}
+}
@@ -5,13 +5,19 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"expvar"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
-
-	"github.com/alecthomas/kong"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 
@@ -20,17 +26,83 @@ import (
 
 	"github.com/open-policy-agent/opa/logging"
 	"github.com/open-policy-agent/opa/sdk"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
 )
 
 var CLI struct {
-	Storage    string `name:"path" short:"p" type:"path" default:"./" help:"Directory where persistent data should be stored."`
-	Port       int    `name:"port" short:"P" type:"int" default:8123 help:"Port where API should be served."`
-	Config     string `name:"config" short:"c" type:"path" help:"Path to OPA configuration file (sdk mode only)"`
-	Rule       string `name:"rule" short:"r" default:"/main/main" type:"string" help:"OPA rule path (sdk mode only)"`
-	Allow      string `name:"allow" short:"a" default:"outcome/allow" type:"string" help:"path within the OPA rule to extract the allow/deny decision"`
-	OPA        string `name:"opa" short:"o" type:"string" help:"URL for the OPA server (http mode only)"`
-	Mode       string `name:"mode" short:"m" type:"string" default:"sdk" help:"Mode in which to use OPA, choices are 'sdk', 'http', 'allow-all', 'deny-all'"`
-	Playground bool   `name:"playground" short:"g" help:"Enable the /playground web UI. Only works in sdk mode."`
+	ConfigFile string        `name:"config-file" type:"path" help:"YAML or TOML file setting any of the other flags, keyed by their long names. Environment variables and flags take precedence over it."`
+	Storage    string        `name:"path" short:"p" type:"path" default:"./" help:"Directory where persistent data should be stored."`
+	Backend    string        `name:"storage-backend" enum:"json,bolt" default:"json" help:"Storage backend to use for persistent data, choices are 'json', 'bolt'. The bolt backend imports an existing data.json on first use."`
+	Compact    time.Duration `name:"compact-interval" default:"30s" help:"How often the journal should be folded into data.json (json storage backend only)."`
+	Port       int           `name:"port" short:"P" type:"int" default:"8123" help:"Port where API should be served."`
+	Config     string        `name:"config" short:"c" type:"path" help:"Path to OPA configuration file (sdk mode only)"`
+	Rule       string        `name:"rule" short:"r" default:"/main/main" type:"string" help:"OPA rule path (sdk mode only)"`
+	Allow      string        `name:"allow" short:"a" default:"outcome/allow" type:"string" help:"path within the OPA rule to extract the allow/deny decision, e.g. 'outcome/allow', 'outcome.enforced[0].allowed', or '' if the rule returns a bare boolean"`
+	OPA        string        `name:"opa" short:"o" type:"string" help:"URL for the OPA server (http mode only)"`
+	Mode       []string      `name:"mode" short:"m" default:"sdk" help:"Mode in which to use OPA, choices are 'sdk', 'http', 'allow-all', 'deny-all'. Several modes may be given, separated by commas, in which case each is tried in turn until one gives a decision, e.g. 'sdk,http,deny-all'."`
+	FilterCars bool          `name:"filter-cars" help:"Ask OPA about each car listed by GET /cars, and omit the cars the subject may not GET individually."`
+	Protected  []string      `name:"protected-field" help:"Only let subjects read or write this field if the Entitlements policy grants it via entz, e.g. 'read:status.price'. May be repeated." placeholder:"RESOURCE.FIELD"`
+	Retries    int           `name:"opa-retries" default:"2" help:"How many times to retry a failed request to OPA (http mode only)."`
+	Backoff    time.Duration `name:"opa-retry-backoff" default:"100ms" help:"Delay before the first retry, which doubles for each subsequent retry, with jitter (http mode only)."`
+	Threshold  int           `name:"opa-breaker-threshold" default:"5" help:"Number of consecutive failed decisions after which OPA is considered down and requests fail fast, or 0 to never fail fast (http mode only)."`
+	Cooldown   time.Duration `name:"opa-breaker-cooldown" default:"10s" help:"How long to fail fast for before trying OPA again (http mode only)."`
+	FailOpen   bool          `name:"opa-fail-open" help:"Allow requests while OPA is considered down, rather than rejecting them with 503 (http mode only)."`
+	Timeout    time.Duration `name:"decision-timeout" default:"5s" help:"How long to wait for each decision before rejecting the request with 503, or 0 to wait indefinitely."`
+	CacheTTL   time.Duration `name:"cache-ttl" default:"0s" help:"How long decisions should be cached for, or 0 to disable the decision cache. The cache is flushed whenever a new bundle is activated (sdk mode only)."`
+	CacheSize  int           `name:"cache-size" default:"10000" help:"Maximum number of decisions to cache."`
+	ShadowRule string        `name:"shadow-rule" help:"Also evaluate this rule path with the embedded OPA, in the background, and record where it disagrees with the enforced decision (requires sdk mode)."`
+	ShadowOPA  string        `name:"shadow-opa" help:"Also ask the OPA server at this URL for a decision, in the background, and record where it disagrees with the enforced decision."`
+	ShadowLog  string        `name:"shadow-log" type:"path" default:"shadow.jsonl" help:"File to which disagreements between the enforced and shadow decisions are appended, as JSONL."`
+	Monitor    bool          `name:"monitor-only" help:"Log requests which the policy denies, but allow them anyway, tagging the response with an X-Entitlements-Would-Deny header."`
+	MonitorOn  []string      `name:"monitor-route" help:"Like --monitor-only, but only for requests matching this route, e.g. 'PUT /cars/{id}/status'. May be repeated." placeholder:"[METHOD] PATH"`
+	BodyOn     []string      `name:"body-route" help:"Pass the JSON body of requests matching this route to OPA in context.body, e.g. 'PUT /cars/{id}/status'. May be repeated." placeholder:"[METHOD] PATH"`
+	BodyLimit  int64         `name:"body-limit" default:"65536" help:"Largest request body, in bytes, which --body-route will buffer. Larger requests are rejected with 413."`
+	HideDeny   bool          `name:"hide-deny-reasons" help:"Only say that a request was denied in 403 responses, rather than including the decision ID, decision type and the messages of the denying rules."`
+	DecLog     string        `name:"decision-log" type:"path" help:"Append a JSONL record of the decision made for each request, with its input, result, latency and response status, to this file."`
+	DecLogSize int64         `name:"decision-log-max-size" default:"104857600" help:"Size in bytes at which the decision log is rotated."`
+	DecLogKeep int           `name:"decision-log-max-files" default:"5" help:"Number of rotated decision log files to keep."`
+	DecLogMask []string      `name:"decision-log-mask" default:"jwt,context.headers.Authorization" help:"Path within the input whose value is masked in the decision and shadow logs. May be repeated. The --api-key-header is always masked." placeholder:"PATH"`
+	JWTSecret  string        `name:"jwt-secret-file" type:"path" help:"Verify 'Authorization: Bearer' JWTs using the HMAC secret in this file."`
+	JWKS       string        `name:"jwks" type:"path" help:"Verify 'Authorization: Bearer' JWTs using the keys in this JWKS file."`
+	JWTSubject string        `name:"jwt-subject-claim" default:"sub" help:"Claim holding the subject."`
+	JWTRoles   string        `name:"jwt-roles-claim" default:"roles" help:"Claim holding the subject's roles."`
+	JWTGroups  string        `name:"jwt-groups-claim" default:"groups" help:"Claim holding the subject's groups."`
+	JWTAttrs   []string      `name:"jwt-attribute-claim" help:"Claim to copy into the subject attributes. May be repeated."`
+	JWTIssuer  string        `name:"jwt-issuer" help:"Only accept tokens with this issuer."`
+	JWTAud     string        `name:"jwt-audience" help:"Only accept tokens for this audience."`
+	JWTNoExp   bool          `name:"jwt-allow-no-exp" help:"Accept tokens without an 'exp' claim, which are otherwise rejected since they never expire."`
+	Htpasswd   string        `name:"htpasswd" type:"path" help:"Authenticate HTTP Basic credentials against the users in this htpasswd file. Passwords must be hashed with bcrypt or SHA1."`
+	BasicRealm string        `name:"basic-realm" default:"carinfostore" help:"Realm used in HTTP Basic challenges."`
+	APIKeys    string        `name:"api-keys" type:"path" help:"Authenticate API keys listed in this file, one 'subject:key' per line."`
+	APIKeyHdr  string        `name:"api-key-header" default:"X-API-Key" help:"Header from which API keys are read."`
+	CertField  string        `name:"client-cert-subject" enum:"cn,email,dns,uri" default:"cn" help:"Field of verified TLS client certificates to take the subject from, choices are 'cn', 'email', 'dns', 'uri'."`
+	Resolvers  []string      `name:"subject-resolver" help:"Ways to establish the subject of each request, tried in order, choices are 'jwt', 'client-cert', 'basic', 'api-key', 'user'. Defaults to each of the first four which is configured, or to 'user' if none are. 'user' may only be combined with the others if --allow-user-header is given."`
+	AllowUser  bool          `name:"allow-user-header" help:"Fall back to the unauthenticated User header when other subject resolvers are configured. Anyone can set this header, so this lets clients without credentials act as any subject."`
+	AuthReq    bool          `name:"auth-required" help:"Reject requests for which no subject resolver establishes a subject, rather than passing them to OPA without one."`
+	TLSCert    string        `name:"tls-cert" type:"path" help:"Serve the API over HTTPS with this PEM certificate."`
+	TLSKey     string        `name:"tls-key" type:"path" help:"PEM private key for --tls-cert."`
+	TLSCA      string        `name:"tls-client-ca" type:"path" help:"Verify TLS client certificates against the PEM CA certificates in this file, enabling the client-cert subject resolver."`
+	TLSAuth    string        `name:"tls-client-auth" enum:"verify-if-given,require" default:"verify-if-given" help:"Whether TLS clients must present a certificate, choices are 'verify-if-given', 'require' (requires --tls-client-ca)."`
+	Drain      time.Duration `name:"shutdown-timeout" default:"30s" help:"How long to wait for in-flight requests to finish on SIGINT or SIGTERM, before closing their connections."`
+	AdminPort  int           `name:"admin-port" default:"0" help:"Port where Prometheus metrics should be served at /metrics, and expvar counters at /debug/vars, or 0 to disable."`
+	TraceExp   string        `name:"trace-exporter" enum:"none,otlp,file" default:"none" help:"Where to export OpenTelemetry traces, choices are 'none', 'otlp', 'file'."`
+	OTLPTarget string        `name:"otlp-endpoint" default:"localhost:4318" help:"Host and port of the OTLP/HTTP collector to export traces to (otlp trace exporter only)."`
+	OTLPInsec  bool          `name:"otlp-insecure" help:"Export traces to the OTLP collector over plain HTTP rather than HTTPS."`
+	TraceFile  string        `name:"trace-file" type:"path" default:"traces.jsonl" help:"File to which traces are appended as JSON (file trace exporter only)."`
+	TraceRatio float64       `name:"trace-sample-ratio" default:"1" help:"Fraction of requests to trace, unless the caller's trace context says otherwise."`
+	Playground bool          `name:"playground" short:"g" help:"Enable the /playground web UI. Only works in sdk mode."`
+
+	Serve     struct{} `cmd:"" default:"withargs" help:"Serve the API. This is the default command."`
+	ConfigCmd struct {
+		Validate struct{} `cmd:"" help:"Report any errors in the settings, without starting the server."`
+	} `cmd:"" name:"config" help:"Work with the settings given by flags, environment variables and the config file."`
 }
 
 var dummyAllow string = `
@@ -65,7 +137,7 @@ var dummyDeny string = `
     "allowed": false,
     "entz": [],
     "outcome": {
-      "allow": true,
+      "allow": false,
       "decision_type": "DENIED",
       "enforced": [
         {
@@ -83,32 +155,68 @@ var dummyDeny string = `
 }
 `
 
-func main() {
-	kong.Parse(&CLI)
+// failOpenDecision returns the decision which is used while OPA is down, if
+// --opa-fail-open is given. It allows every request.
+func failOpenDecision(allowPath sample.ResultPath) *sample.OPADecision {
+	return &sample.OPADecision{
+		ID:     "fail-open",
+		Result: allowPath.Build(true),
+	}
+}
+
+// deciderModes builds the OPADecider for each mode given via --mode, and
+// keeps track of the parts of them that the rest of the server needs.
+type deciderModes struct {
+	allowPath sample.ResultPath
+
+	// opa is the embedded OPA, and policy keeps track of its bundles, if
+	// the sdk mode is used.
+	opa    *sdk.OPA
+	policy *sample.PolicyStatus
 
-	var decider sample.OPADecider
+	// health reports on the OPA sidecar, if the http mode is used.
+	health sample.HealthReporter
 
-	if CLI.Mode == "sdk" {
+	// sidecar probes whether the OPA sidecar is ready, if the http mode
+	// is used.
+	sidecar sample.ReadinessChecker
+
+	// caches holds the decision cache for each mode, if --cache-ttl is
+	// given.
+	caches map[string]*sample.CachingDecider
+}
+
+// newDecider builds the decider for the mode. Each mode may only be used
+// once.
+func (m *deciderModes) newDecider(ctx context.Context, mode string) (sample.OPADecider, error) {
+	switch mode {
+	case "sdk":
+		if m.opa != nil {
+			return nil, fmt.Errorf("mode 'sdk' given more than once")
+		}
 
 		if CLI.Config == "" {
-			panic("config must be provided in sdk mode")
+			return nil, fmt.Errorf("config must be provided in sdk mode")
 		}
 
 		if CLI.Rule == "" {
-			panic("rule must be provided in sdk mode")
+			return nil, fmt.Errorf("rule must be provided in sdk mode")
 		}
 
-		ctx := context.Background()
-
 		f, err := os.Open(CLI.Config)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 		defer f.Close()
 
-		// create a new OPA client with the config
+		// create a new OPA client with the config. Passing a Ready
+		// channel stops sdk.New from blocking until the bundles have
+		// been activated, so that the server can start, and report
+		// that it is not ready yet in the meantime.
+		ready := make(chan struct{})
 		opa, err := sdk.New(ctx, sdk.Options{
 			Config: f,
+			Ready:  ready,
 
 			// This is not suggested for production use, but is
 			// nice for the sample as it allows seeing when OPA
@@ -116,75 +224,689 @@ func main() {
 			Logger: logging.New(),
 		})
 		if err != nil {
-			panic(err)
+			return nil, err
+		}
+		m.opa = opa
+		m.policy = sample.NewPolicyStatus(opa, ready)
+
+		decider := sample.NewSDKDecider(opa, CLI.Rule)
+
+		if CLI.CacheTTL > 0 {
+			cache := m.cache(mode, decider)
+			cache.FlushOnBundleUpdate(opa)
+			decider = cache
+		}
+
+		return decider, nil
+
+	case "http":
+		if m.health != nil {
+			return nil, fmt.Errorf("mode 'http' given more than once")
+		}
+
+		httpOpts := []sample.HTTPDeciderOption{
+			sample.WithRetries(CLI.Retries, CLI.Backoff),
 		}
 
-		defer opa.Stop(ctx)
+		if CLI.Threshold > 0 {
+			var fallback *sample.OPADecision
+			if CLI.FailOpen {
+				fallback = failOpenDecision(m.allowPath)
+			}
+			httpOpts = append(httpOpts, sample.WithCircuitBreaker(CLI.Threshold, CLI.Cooldown, fallback))
+		}
 
-		decider = sample.NewSDKDecider(opa, ctx, CLI.Rule)
+		decider := sample.NewHTTPDecider(CLI.OPA, httpOpts...)
+		m.health = decider.(sample.HealthReporter)
+		m.sidecar = decider.(sample.ReadinessChecker)
 
-		if CLI.Playground {
-			playground.SetOPARule("/main/main", "outcome/allow")
-			playground.SetOPA(opa, ctx)
+		if CLI.CacheTTL > 0 {
+			decider = m.cache(mode, decider)
 		}
 
-	} else if CLI.Mode == "http" {
+		return decider, nil
 
-		decider = sample.NewHTTPDecider(CLI.OPA)
+	case "allow-all":
+		return newDummyDecider(dummyAllow)
 
-	} else if CLI.Mode == "allow-all" {
+	case "deny-all":
+		return newDummyDecider(dummyDeny)
+
+	default:
+		return nil, fmt.Errorf("mode '%s' is not one of sdk, http, allow-all, deny-all", mode)
+	}
+}
+
+// newShadowDecider builds the decider given by --shadow-rule or
+// --shadow-opa, or returns nil if neither was given.
+func (m *deciderModes) newShadowDecider() (sample.OPADecider, error) {
+	switch {
+	case CLI.ShadowRule != "" && CLI.ShadowOPA != "":
+		return nil, fmt.Errorf("only one of shadow-rule and shadow-opa may be given")
+
+	case CLI.ShadowRule != "":
+		if m.opa == nil {
+			return nil, fmt.Errorf("shadow-rule requires sdk mode")
+		}
+		return sample.NewSDKDecider(m.opa, CLI.ShadowRule), nil
+
+	case CLI.ShadowOPA != "":
+		return sample.NewHTTPDecider(CLI.ShadowOPA, sample.WithRetries(CLI.Retries, CLI.Backoff)), nil
+	}
 
-		decision := &sample.OPADecision{}
-		err := json.Unmarshal([]byte(dummyAllow), decision)
+	return nil, nil
+}
+
+// cache wraps the decider for the mode in a CachingDecider.
+func (m *deciderModes) cache(mode string, decider sample.OPADecider) *sample.CachingDecider {
+	if m.caches == nil {
+		m.caches = map[string]*sample.CachingDecider{}
+	}
+
+	cache := sample.NewCachingDecider(decider, CLI.CacheTTL, CLI.CacheSize)
+	m.caches[mode] = cache
+	return cache
+}
+
+// newDummyDecider creates a DummyDecider which always returns the decision
+// encoded in raw.
+func newDummyDecider(raw string) (sample.OPADecider, error) {
+	decision := &sample.OPADecision{}
+	err := json.Unmarshal([]byte(raw), decision)
+	if err != nil {
+		return nil, err
+	}
+
+	return sample.NewDummyDecider(decision), nil
+}
+
+// newJWTVerifier creates the JWTVerifier configured by the jwt flags.
+func newJWTVerifier() (*sample.JWTVerifier, error) {
+	claims := sample.JWTClaims{
+		Subject:       CLI.JWTSubject,
+		Roles:         CLI.JWTRoles,
+		Groups:        CLI.JWTGroups,
+		Attributes:    CLI.JWTAttrs,
+		Issuer:        CLI.JWTIssuer,
+		Audience:      CLI.JWTAud,
+		AllowNoExpiry: CLI.JWTNoExp,
+	}
+
+	if CLI.JWTSecret != "" && CLI.JWKS != "" {
+		return nil, fmt.Errorf("only one of jwt-secret-file and jwks may be given")
+	}
+
+	if CLI.JWKS != "" {
+		return sample.NewJWKSJWTVerifier(CLI.JWKS, claims)
+	}
+
+	secret, err := os.ReadFile(CLI.JWTSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	return sample.NewHMACJWTVerifier(bytes.TrimSpace(secret), claims)
+}
+
+// newSubjectResolver creates the SubjectResolver with the given name.
+func newSubjectResolver(name string) (sample.SubjectResolver, error) {
+	switch name {
+	case "jwt":
+		if CLI.JWTSecret == "" && CLI.JWKS == "" {
+			return nil, fmt.Errorf("subject resolver 'jwt' requires jwt-secret-file or jwks")
+		}
+
+		verifier, err := newJWTVerifier()
 		if err != nil {
-			panic(err)
+			return nil, err
+		}
+		return verifier, nil
+
+	case "client-cert":
+		if CLI.TLSCA == "" {
+			return nil, fmt.Errorf("subject resolver 'client-cert' requires tls-client-ca")
+		}
+
+		resolver, err := sample.NewClientCertResolver(CLI.CertField)
+		if err != nil {
+			return nil, err
+		}
+		return resolver, nil
+
+	case "basic":
+		if CLI.Htpasswd == "" {
+			return nil, fmt.Errorf("subject resolver 'basic' requires htpasswd")
+		}
+
+		resolver, err := sample.NewHtpasswdResolver(CLI.Htpasswd, CLI.BasicRealm)
+		if err != nil {
+			return nil, err
+		}
+		return resolver, nil
+
+	case "api-key":
+		if CLI.APIKeys == "" {
+			return nil, fmt.Errorf("subject resolver 'api-key' requires api-keys")
+		}
+
+		resolver, err := sample.NewAPIKeyResolver(CLI.APIKeys, CLI.APIKeyHdr)
+		if err != nil {
+			return nil, err
+		}
+		return resolver, nil
+
+	case "user":
+		return sample.UserHeaderResolver{}, nil
+
+	default:
+		return nil, fmt.Errorf("subject resolver '%s' is not one of jwt, client-cert, basic, api-key, user", name)
+	}
+}
+
+// subjectResolverNames returns the names of the subject resolvers to use, in
+// order, as given by --subject-resolver or implied by the other flags. The
+// User header is only implied if no other way of authenticating requests is
+// configured, or if --allow-user-header is given, since anyone can set it.
+func subjectResolverNames() []string {
+	if len(CLI.Resolvers) > 0 {
+		return CLI.Resolvers
+	}
+
+	names := []string{}
+	if CLI.JWTSecret != "" || CLI.JWKS != "" {
+		names = append(names, "jwt")
+	}
+	if CLI.TLSCA != "" {
+		names = append(names, "client-cert")
+	}
+	if CLI.Htpasswd != "" {
+		names = append(names, "basic")
+	}
+	if CLI.APIKeys != "" {
+		names = append(names, "api-key")
+	}
+	if !CLI.AuthReq && (len(names) == 0 || CLI.AllowUser) {
+		names = append(names, "user")
+	}
+	return names
+}
+
+// checkSubjectResolverNames checks that the User header is not used
+// alongside real authentication, unless --allow-user-header is given, since
+// it would let clients without credentials claim to be any subject.
+func checkSubjectResolverNames(names []string) error {
+	if len(names) == 0 {
+		return fmt.Errorf("auth-required requires a subject resolver other than 'user'")
+	}
+
+	if len(names) > 1 && !CLI.AllowUser {
+		for _, name := range names {
+			if name == "user" {
+				return fmt.Errorf("subject resolver 'user' may only be combined with others if allow-user-header is given")
+			}
+		}
+	}
+
+	return nil
+}
+
+// newTLSConfig creates the TLS configuration for serving the API, which
+// verifies client certificates if --tls-client-ca is given.
+func newTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if CLI.TLSCA == "" {
+		if CLI.TLSAuth == "require" {
+			return nil, fmt.Errorf("tls-client-auth 'require' requires tls-client-ca")
+		}
+		return config, nil
+	}
+
+	pem, err := os.ReadFile(CLI.TLSCA)
+	if err != nil {
+		return nil, err
+	}
+
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in '%s'", CLI.TLSCA)
+	}
+
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if CLI.TLSAuth == "require" {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// newTracerProvider creates the TracerProvider configured by the trace
+// flags, and returns a function which flushes and stops it.
+func newTracerProvider(ctx context.Context) (*sdktrace.TracerProvider, func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	closeFile := func() error { return nil }
+
+	switch CLI.TraceExp {
+	case "otlp":
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(CLI.OTLPTarget)}
+		if CLI.OTLPInsec {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+
+		var err error
+		exporter, err = otlptracehttp.New(ctx, opts...)
+		if err != nil {
+			return nil, nil, err
+		}
+
+	case "file":
+		f, err := os.OpenFile(CLI.TraceFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+		closeFile = f.Close
+
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+
+	default:
+		return nil, nil, fmt.Errorf("trace exporter '%s' is not one of otlp, file", CLI.TraceExp)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(CLI.TraceRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String("carinfoserver"),
+		)),
+	)
+
+	shutdown := func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if cerr := closeFile(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+
+	return provider, shutdown, nil
+}
+
+// shutdownStep releases one of the server's resources on shutdown.
+type shutdownStep struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// shutdownSteps are run in the reverse of the order in which they were added,
+// like deferred calls, so that each resource is released before the ones it
+// depends on.
+type shutdownSteps []shutdownStep
+
+// add adds a step, which is described by name in log messages.
+func (s *shutdownSteps) add(name string, run func(ctx context.Context) error) {
+	*s = append(*s, shutdownStep{name: name, run: run})
+}
+
+// addCloser adds a step which calls a Close method.
+func (s *shutdownSteps) addCloser(name string, closer func() error) {
+	s.add(name, func(context.Context) error {
+		return closer()
+	})
+}
+
+// run runs every step, even if some fail, and returns false if any did.
+func (s shutdownSteps) run(ctx context.Context) bool {
+	ok := true
+	for i := len(s) - 1; i >= 0; i-- {
+		err := s[i].run(ctx)
+		if err != nil {
+			log.Printf("failed to %s: %v\n", s[i].name, err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// serveUntilSignalled waits for SIGINT or SIGTERM, or for one of the servers
+// to fail. It then stops the servers accepting connections, waits up to
+// --shutdown-timeout for in-flight requests to finish, and runs the shutdown
+// steps. It returns the status code to exit with, which is 0 if the server
+// was signalled and shut down cleanly, or 1 otherwise.
+func serveUntilSignalled(servers []*http.Server, serveErrs <-chan error, steps *shutdownSteps) int {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	code := 0
+	select {
+	case sig := <-signals:
+		log.Printf("received %v, shutting down\n", sig)
+	case err := <-serveErrs:
+		log.Printf("server failed, shutting down: %v\n", err)
+		code = 1
+	}
+
+	// A second signal kills the process straight away.
+	signal.Stop(signals)
+
+	ctx, cancel := context.WithTimeout(context.Background(), CLI.Drain)
+	defer cancel()
+
+	for _, server := range servers {
+		err := server.Shutdown(ctx)
+		if err != nil {
+			log.Printf("failed to finish in-flight requests on %s, closing their connections: %v\n", server.Addr, err)
+			server.Close()
+			code = 1
 		}
+	}
+
+	// The steps get a deadline of their own, so that they can still flush
+	// everything if draining took the whole timeout.
+	ctx, cancel = context.WithTimeout(context.Background(), CLI.Drain)
+	defer cancel()
+
+	if !steps.run(ctx) {
+		code = 1
+	}
 
-		decider = sample.NewDummyDecider(decision)
+	log.Printf("shut down\n")
+	return code
+}
 
-	} else if CLI.Mode == "deny-all" {
+// openStore opens the CarStore for the given backend, using dir as the
+// storage directory.
+func openStore(backend, dir string) (sample.CarStore, error) {
+	switch backend {
+	case "json":
+		store, err := sample.NewJSONFileStore(dir)
+		if err != nil {
+			return nil, err
+		}
 
-		decision := &sample.OPADecision{}
-		err := json.Unmarshal([]byte(dummyDeny), decision)
+		err = store.LoadFromDisk()
+		if err != nil {
+			return nil, err
+		}
+
+		store.CompactEvery(CLI.Compact)
+		return store, nil
+
+	case "bolt":
+		return sample.NewBoltStore(dir)
+
+	default:
+		return nil, fmt.Errorf("storage backend '%s' is not one of json, bolt", backend)
+	}
+}
+
+func main() {
+	ctx := parseCLI()
+
+	errs := validateConfig()
+	if len(errs) > 0 {
+		reportConfigErrors(errs)
+		os.Exit(exitInvalidConfig)
+	}
+
+	if ctx.Command() == "config validate" {
+		fmt.Printf("configuration is valid\n")
+		return
+	}
+
+	os.Exit(serve())
+}
+
+// serve serves the API until it is signalled to stop, and returns the status
+// code to exit with once it has shut down.
+func serve() int {
+
+	allowPath, err := sample.ParseResultPath(CLI.Allow)
+	if err != nil {
+		panic(err)
+	}
+
+	ctx := context.Background()
+
+	// steps releases everything that needs releasing once the server has
+	// stopped serving requests.
+	steps := &shutdownSteps{}
+
+	// Trace context is always propagated from callers to the OPA sidecar,
+	// even if this server's own spans are not exported.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if CLI.TraceExp != "none" {
+		provider, shutdown, err := newTracerProvider(ctx)
 		if err != nil {
 			panic(err)
 		}
+		steps.add("flush traces", shutdown)
 
-		decider = sample.NewDummyDecider(decision)
+		otel.SetTracerProvider(provider)
+	}
 
-	} else {
-		panic(fmt.Sprintf("mode '%s' is not one of sdk, http, allow-all, deny-all", CLI.Mode))
+	modes := &deciderModes{allowPath: allowPath}
+	chain := []sample.NamedDecider{}
+	for _, mode := range CLI.Mode {
+		d, err := modes.newDecider(ctx, mode)
+		if err != nil {
+			panic(err)
+		}
+		chain = append(chain, sample.NamedDecider{Name: mode, Decider: d})
 	}
 
-	if CLI.Playground {
+	if modes.opa != nil {
+		steps.add("stop OPA", func(ctx context.Context) error {
+			modes.opa.Stop(ctx)
+			return nil
+		})
+	}
 
+	var decider sample.OPADecider = sample.NewFallbackDecider(chain...)
+
+	masks := []sample.ResultPath{}
+	for _, mask := range CLI.DecLogMask {
+		path, err := sample.ParseResultPath(mask)
+		if err != nil {
+			panic(err)
+		}
+		masks = append(masks, path)
 	}
 
-	err := sample.SetStorageDir(CLI.Storage)
+	// The API key header is masked whatever the configured masks are,
+	// since it is always a secret. Inputs hold headers under their
+	// canonical names.
+	masks = append(masks, sample.ResultPath{"context", "headers", http.CanonicalHeaderKey(CLI.APIKeyHdr)})
+
+	// Protected fields are passed to OPA as resource attributes, but
+	// must not be revealed by the logs.
+	masks = append(masks, sample.CarAttributeMasks(CLI.Protected)...)
+
+	shadow, err := modes.newShadowDecider()
 	if err != nil {
 		panic(err)
 	}
 
-	sample.LoadFromDisk()
+	if shadow != nil {
+		f, err := os.OpenFile(CLI.ShadowLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			panic(err)
+		}
+		steps.addCloser("close shadow log", f.Close)
+
+		shadowDecider := sample.NewShadowDecider(decider, shadow, allowPath, CLI.Timeout, f, masks)
+		steps.addCloser("finish shadow evaluations", shadowDecider.Close)
+
+		expvar.Publish("shadow_decisions", expvar.Func(func() interface{} {
+			return shadowDecider.Stats()
+		}))
+
+		decider = shadowDecider
+	}
+
+	store, err := openStore(CLI.Backend, CLI.Storage)
+	if err != nil {
+		panic(err)
+	}
+	steps.addCloser("close store", store.Close)
 
 	r := mux.NewRouter().StrictSlash(false)
 	carsRouter := r.PathPrefix("/cars")
-	carsRouter.Handler(sample.NewEntitlementsHandler(decider, sample.GetAPIHandler()))
+	entzOpts := []sample.EntitlementsOption{
+		sample.WithAllowPath(allowPath),
+		sample.WithDecisionTimeout(CLI.Timeout),
+		sample.WithResourceAttributes(sample.CarAttributes(store)),
+		sample.WithRouteTemplates(sample.APIRouteTemplates()),
+	}
+	if CLI.FilterCars {
+		entzOpts = append(entzOpts, sample.WithItemFiltering())
+	}
+	if len(CLI.Protected) > 0 {
+		entzOpts = append(entzOpts, sample.WithFieldEntitlements(CLI.Protected))
+	}
+	if names := subjectResolverNames(); len(names) != 1 || names[0] != "user" {
+		err := checkSubjectResolverNames(names)
+		if err != nil {
+			panic(err)
+		}
+
+		resolvers := []sample.SubjectResolver{}
+		for _, name := range names {
+			resolver, err := newSubjectResolver(name)
+			if err != nil {
+				panic(err)
+			}
+			resolvers = append(resolvers, resolver)
+		}
+		entzOpts = append(entzOpts, sample.WithSubjectResolvers(CLI.AuthReq, resolvers...))
+	}
+	if len(CLI.BodyOn) > 0 {
+		routes, err := sample.ParseRouteTemplates(CLI.BodyOn)
+		if err != nil {
+			panic(err)
+		}
+		entzOpts = append(entzOpts, sample.WithRequestBodies(routes, CLI.BodyLimit))
+	}
+	if !CLI.HideDeny {
+		entzOpts = append(entzOpts, sample.WithDenyReasons())
+	}
+	if CLI.DecLog != "" {
+		logger, err := sample.NewDecisionLogger(CLI.DecLog, CLI.DecLogSize, CLI.DecLogKeep, masks)
+		if err != nil {
+			panic(err)
+		}
+		steps.addCloser("close decision log", logger.Close)
+
+		entzOpts = append(entzOpts, sample.WithDecisionLog(logger))
+	}
+	if CLI.Monitor {
+		entzOpts = append(entzOpts, sample.WithMonitorOnly())
+	}
+	if len(CLI.MonitorOn) > 0 {
+		routes, err := sample.ParseRouteTemplates(CLI.MonitorOn)
+		if err != nil {
+			panic(err)
+		}
+		entzOpts = append(entzOpts, sample.WithMonitorOnlyRoutes(routes))
+	}
+
+	carsRouter.Handler(sample.NewEntitlementsHandler(decider, sample.GetAPIHandler(store), entzOpts...))
+
+	if len(modes.caches) > 0 {
+		expvar.Publish("decision_cache", expvar.Func(func() interface{} {
+			stats := map[string]sample.CacheStats{}
+			for mode, cache := range modes.caches {
+				stats[mode] = cache.Stats()
+			}
+			return stats
+		}))
+	}
+
+	if modes.health != nil {
+		r.Handle("/health/opa", sample.GetHealthHandler(modes.health))
+	}
+
+	readinessChecks := map[string]sample.ReadinessChecker{
+		"store": sample.StoreReadiness(store),
+	}
+	if modes.policy != nil {
+		readinessChecks["policy"] = modes.policy
+		r.Handle("/status/policy", sample.GetPolicyStatusHandler(modes.policy))
+	}
+	if modes.sidecar != nil {
+		readinessChecks["opa"] = modes.sidecar
+	}
+	r.Handle("/healthz", sample.GetLivenessHandler())
+	r.Handle("/readyz", sample.GetReadinessHandler(readinessChecks))
+
+	if modes.opa != nil {
+		sample.RecordBundleMetrics(modes.opa)
+	}
+
+	servers := []*http.Server{}
+	serveErrs := make(chan error, 2)
+
+	if CLI.AdminPort != 0 {
+		adminRouter := mux.NewRouter()
+		adminRouter.Handle("/metrics", sample.GetMetricsHandler())
+		adminRouter.Handle("/debug/vars", expvar.Handler())
+
+		admin := &http.Server{
+			Addr:    fmt.Sprintf(":%d", CLI.AdminPort),
+			Handler: adminRouter,
+		}
+		servers = append(servers, admin)
+
+		go func() {
+			serveErrs <- admin.ListenAndServe()
+		}()
+	}
 
 	if CLI.Playground {
 		fmt.Printf("Enabling playground...\n")
 
-		if CLI.Mode != "sdk" {
+		if modes.opa == nil {
 			panic("entz-playground can only be enabled in sdk mode")
 		}
 
+		playground.SetOPARule("/main/main", "outcome/allow")
+		playground.SetOPA(modes.opa, ctx)
+
 		playgroundRouter := r.PathPrefix("/")
 		playgroundRouter.Handler(playground.GetAPIHandler())
 	}
 
-	err = http.ListenAndServe(fmt.Sprintf(":%d", CLI.Port), r)
-	if err != nil {
-		panic(err)
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", CLI.Port),
+		Handler: r,
+	}
+	servers = append(servers, server)
+
+	if CLI.TLSCert != "" || CLI.TLSKey != "" {
+		server.TLSConfig, err = newTLSConfig()
+		if err != nil {
+			panic(err)
+		}
+
+		go func() {
+			serveErrs <- server.ListenAndServeTLS(CLI.TLSCert, CLI.TLSKey)
+		}()
+	} else {
+		if CLI.TLSCA != "" {
+			panic("tls-client-ca requires tls-cert and tls-key")
+		}
+
+		go func() {
+			serveErrs <- server.ListenAndServe()
+		}()
 	}
 
+	return serveUntilSignalled(servers, serveErrs, steps)
 }
@@ -0,0 +1,209 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DecisionLogRecord is a single line of a decision log, recording the
+// decision made for a request and how the request was answered.
+type DecisionLogRecord struct {
+	Timestamp  time.Time `json:"timestamp"`
+	DecisionID string    `json:"decision_id,omitempty"`
+	Source     string    `json:"source,omitempty"`
+
+	// Cached is true if the decision was cached, in which case
+	// DecisionID is that of the request it was first made for.
+	Cached bool `json:"cached,omitempty"`
+
+	Method  string `json:"method"`
+	Path    string `json:"path"`
+	Subject string `json:"subject"`
+
+	Input   interface{} `json:"input"`
+	Result  interface{} `json:"result,omitempty"`
+	Allowed bool        `json:"allowed"`
+	Error   string      `json:"error,omitempty"`
+
+	// Status is the HTTP status code the request was answered with.
+	Status int `json:"status"`
+
+	// DecisionLatency is how long the decision took, and
+	// RequestDuration how long the whole request took, both in
+	// milliseconds.
+	DecisionLatency float64 `json:"decision_latency_ms"`
+	RequestDuration float64 `json:"request_duration_ms"`
+}
+
+// DecisionLogger writes DecisionLogRecords to a file as JSONL, rotating it
+// once it grows too large. Rotated files are renamed with a numeric suffix,
+// so that "decisions.jsonl.1" is the most recent, and the oldest are deleted
+// once there are too many.
+//
+// Values at the configured mask paths are replaced in each logged input, so
+// that secrets such as bearer tokens do not end up in the log.
+type DecisionLogger struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	masks    []ResultPath
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+// NewDecisionLogger opens the decision log at path, appending to it if it
+// exists. The log is rotated once it would grow beyond maxSize bytes, and
+// at most maxFiles rotated files are kept. Values at each of the mask paths,
+// such as "jwt" or "context.headers.Authorization", are masked in logged
+// inputs.
+func NewDecisionLogger(path string, maxSize int64, maxFiles int, masks []ResultPath) (*DecisionLogger, error) {
+	l := &DecisionLogger{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		masks:    masks,
+	}
+
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// open opens the log file for appending.
+func (l *DecisionLogger) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// rotatedPath returns the path of the nth most recent rotated file.
+func (l *DecisionLogger) rotatedPath(n int) string {
+	return l.path + "." + strconv.Itoa(n)
+}
+
+// rotate closes the log file, shifts the rotated files along, deleting the
+// oldest, and opens a new log file.
+func (l *DecisionLogger) rotate() error {
+	err := l.file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(l.rotatedPath(l.maxFiles))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for n := l.maxFiles - 1; n >= 1; n-- {
+		err = os.Rename(l.rotatedPath(n), l.rotatedPath(n+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if l.maxFiles > 0 {
+		err = os.Rename(l.path, l.rotatedPath(1))
+	} else {
+		err = os.Remove(l.path)
+	}
+	if err != nil {
+		return err
+	}
+
+	return l.open()
+}
+
+// Log masks the record's input, and appends the record to the log.
+func (l *DecisionLogger) Log(record *DecisionLogRecord) error {
+	input, err := maskPaths(record.Input, l.masks)
+	if err != nil {
+		return fmt.Errorf("failed to mask input of decision %s: %w", record.DecisionID, err)
+	}
+
+	masked := *record
+	masked.Input = input
+
+	raw, err := json.Marshal(&masked)
+	if err != nil {
+		return fmt.Errorf("failed to encode decision %s: %w", record.DecisionID, err)
+	}
+	raw = append(raw, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.size > 0 && l.size+int64(len(raw)) > l.maxSize {
+		err = l.rotate()
+		if err != nil {
+			return fmt.Errorf("failed to rotate decision log: %w", err)
+		}
+	}
+
+	n, err := l.file.Write(raw)
+	l.size += int64(n)
+	return err
+}
+
+// Close closes the log file. The logger must not be used afterwards.
+func (l *DecisionLogger) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.file.Close()
+}
+
+// statusRecorder records the status code written through a ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader implements http.ResponseWriter.WriteHeader.
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Status returns the status code which was written, or 200 if nothing has
+// been written yet, since that is what will be sent.
+func (s *statusRecorder) Status() int {
+	if s.status == 0 {
+		return http.StatusOK
+	}
+	return s.status
+}
+
+// Write implements http.ResponseWriter.Write.
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
@@ -0,0 +1,182 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readDecisionLog returns the IDs of the decisions recorded in the file, or
+// nil if it does not exist.
+func readDecisionLog(t *testing.T, path string) []string {
+	t.Helper()
+
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(raw)), "\n") {
+		var record DecisionLogRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("failed to parse %q: %v", line, err)
+		}
+		ids = append(ids, record.DecisionID)
+	}
+	return ids
+}
+
+// logDecisions logs a record for each of the decision IDs in turn.
+func logDecisions(t *testing.T, l *DecisionLogger, ids ...string) {
+	t.Helper()
+
+	for _, id := range ids {
+		if err := l.Log(&DecisionLogRecord{DecisionID: id, Input: map[string]interface{}{}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDecisionLoggerRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decisions.jsonl")
+
+	// Every record is larger than the maximum size, so each is written
+	// to a new file.
+	l, err := NewDecisionLogger(path, 1, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	logDecisions(t, l, "d1", "d2", "d3", "d4", "d5")
+
+	for name, expected := range map[string][]string{
+		path:             {"d5"},
+		l.rotatedPath(1): {"d4"},
+		l.rotatedPath(2): {"d3"},
+		l.rotatedPath(3): nil,
+	} {
+		if ids := readDecisionLog(t, name); strings.Join(ids, ",") != strings.Join(expected, ",") {
+			t.Errorf("%s: expected %v, got %v", filepath.Base(name), expected, ids)
+		}
+	}
+}
+
+func TestDecisionLoggerAppendsUntilMaxSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decisions.jsonl")
+
+	l, err := NewDecisionLogger(path, 1<<20, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logDecisions(t, l, "d1", "d2")
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new logger appends to the existing file.
+	l, err = NewDecisionLogger(path, 1<<20, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	logDecisions(t, l, "d3")
+
+	if ids := readDecisionLog(t, path); strings.Join(ids, ",") != "d1,d2,d3" {
+		t.Errorf("expected d1,d2,d3, got %v", ids)
+	}
+	if ids := readDecisionLog(t, l.rotatedPath(1)); ids != nil {
+		t.Errorf("expected no rotated file, got %v", ids)
+	}
+}
+
+func TestDecisionLoggerKeepsNoFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decisions.jsonl")
+
+	l, err := NewDecisionLogger(path, 1, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	logDecisions(t, l, "d1", "d2", "d3")
+
+	if ids := readDecisionLog(t, path); strings.Join(ids, ",") != "d3" {
+		t.Errorf("expected only d3, got %v", ids)
+	}
+	if ids := readDecisionLog(t, l.rotatedPath(1)); ids != nil {
+		t.Errorf("expected no rotated files, got %v", ids)
+	}
+}
+
+func TestDecisionLoggerMasksInput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decisions.jsonl")
+
+	masks := []ResultPath{{"jwt"}, {"context", "headers", "Authorization"}}
+	l, err := NewDecisionLogger(path, 1<<20, 1, masks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	input := &EntitlementsInput{
+		JWT:     "secret-token",
+		Subject: "alice",
+		Context: map[string]interface{}{
+			"headers": http.Header{
+				"Authorization": {"Bearer secret-token"},
+				"Accept":        {"application/json"},
+			},
+		},
+	}
+	err = l.Log(&DecisionLogRecord{DecisionID: "d1", Input: input})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), "secret-token") {
+		t.Errorf("secret was written to the decision log: %s", raw)
+	}
+
+	var record struct {
+		Input struct {
+			JWT     string `json:"jwt"`
+			Subject string `json:"subject"`
+			Context struct {
+				Headers map[string]interface{} `json:"headers"`
+			} `json:"context"`
+		} `json:"input"`
+	}
+	err = json.Unmarshal(raw, &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logged := record.Input
+	if logged.JWT != maskedValue || logged.Subject != "alice" {
+		t.Errorf("unexpected logged input %+v", logged)
+	}
+	if logged.Context.Headers["Authorization"] != maskedValue || logged.Context.Headers["Accept"] == maskedValue {
+		t.Errorf("unexpected logged headers %v", logged.Context.Headers)
+	}
+
+	// The caller's input must not be modified.
+	if input.JWT != "secret-token" || input.Context["headers"].(http.Header).Get("Authorization") != "Bearer secret-token" {
+		t.Errorf("input was modified: %+v", input)
+	}
+}
@@ -1,10 +1,24 @@
 package sample
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Entitlements represents an OPA input document, structured appropriately for
@@ -48,6 +62,37 @@ type EntitlementsOutcome struct {
 	SystemType   string                    `json:"system_type"`
 }
 
+// authorContextKey is the context key under which EntitlementsHandler stores
+// the Author of each request it allows.
+type authorContextKey struct{}
+
+// AuthorFromContext returns the Author of a request which was allowed by an
+// EntitlementsHandler, given the request's context. The bool is false if the
+// request did not pass through an EntitlementsHandler.
+func AuthorFromContext(ctx context.Context) (Author, bool) {
+	author, ok := ctx.Value(authorContextKey{}).(Author)
+	return author, ok
+}
+
+// itemFilterContextKey is the context key under which EntitlementsHandler
+// stores the ItemFilter for each request it allows, if item filtering is
+// enabled.
+type itemFilterContextKey struct{}
+
+// ItemFilter asks OPA whether the subject of the request it was created for
+// may perform the action on each of the resources. It returns a slice which
+// is true at each index where the corresponding resource is allowed.
+type ItemFilter func(action string, resources []string) ([]bool, error)
+
+// ItemFilterFromContext returns the ItemFilter for a request which was allowed
+// by an EntitlementsHandler with item filtering enabled, given the request's
+// context. Handlers which return lists of resources should use it to omit the
+// resources the subject is not entitled to.
+func ItemFilterFromContext(ctx context.Context) (ItemFilter, bool) {
+	filter, ok := ctx.Value(itemFilterContextKey{}).(ItemFilter)
+	return filter, ok
+}
+
 // Assert compliance with the http.Handler interface
 var _ http.Handler = (*EntitlementsHandler)(nil)
 
@@ -55,10 +100,9 @@ var _ http.Handler = (*EntitlementsHandler)(nil)
 // OPADecider, which is expected to return EntitlementsResult objects in it's
 // result field.
 //
-// Because this is intended to be a simple example, we don't do any fancy
-// authentication.
-//
-// The "User" is used as the subject field for entitlements requests.
+// The subject, roles, groups and subject attributes of entitlements
+// requests are established by a chain of SubjectResolvers. By default, the
+// "User" header is used as the subject, without any authentication.
 //
 // URL.Path is used as the resource field for entitlements requests.
 //
@@ -66,17 +110,193 @@ var _ http.Handler = (*EntitlementsHandler)(nil)
 //
 // All HTTP headers are passed into the Context field for entitlements
 // requests in the "headers" sub-field.
+//
+// The subject and decision ID of each allowed request are made available to
+// the wrapped handler via AuthorFromContext().
+//
+// The ID of the decision made for each request is returned in the
+// X-Decision-ID response header, whether or not the request was allowed.
+//
+// Additional behavior can be enabled by passing EntitlementsOptions to
+// NewEntitlementsHandler().
 type EntitlementsHandler struct {
 	decider OPADecider
 	handler http.Handler
+
+	allowPath       ResultPath
+	timeout         time.Duration
+	filterItems     bool
+	protectedFields []string
+
+	monitorAll    bool
+	monitorRoutes RouteTemplates
+
+	resolvers       []SubjectResolver
+	subjectRequired bool
+
+	resourceAttributes ResourceAttributeFunc
+
+	bodyRoutes RouteTemplates
+	bodyLimit  int64
+
+	denyReasons bool
+
+	decisionLog *DecisionLogger
+
+	routes RouteTemplates
+}
+
+// EntitlementsOption configures optional behavior of an EntitlementsHandler.
+type EntitlementsOption func(h *EntitlementsHandler)
+
+// WithAllowPath makes the handler decide whether each request is allowed
+// using the boolean at the given path within the OPA result, rather than the
+// "allowed" field of an Entitlements result. This allows the handler to be
+// used with policies other than Entitlements, including ones which return a
+// bare boolean, in which case the path should be empty.
+func WithAllowPath(path ResultPath) EntitlementsOption {
+	return func(h *EntitlementsHandler) {
+		h.allowPath = path
+	}
+}
+
+// WithDecisionTimeout bounds how long the handler waits for each decision.
+// Requests whose decision times out are rejected with 503.
+func WithDecisionTimeout(timeout time.Duration) EntitlementsOption {
+	return func(h *EntitlementsHandler) {
+		h.timeout = timeout
+	}
+}
+
+// WithMonitorOnly makes the handler pass every request on to the wrapped
+// handler, even if it is denied. Denials are logged, along with the
+// enforced and monitored rules of the Entitlements outcome, and tagged with
+// an X-Entitlements-Would-Deny response header containing the decision ID.
+// This is useful while rolling out a new policy.
+func WithMonitorOnly() EntitlementsOption {
+	return func(h *EntitlementsHandler) {
+		h.monitorAll = true
+	}
+}
+
+// WithMonitorOnlyRoutes is like WithMonitorOnly, but only applies to
+// requests which match one of the routes. Other requests are enforced as
+// usual.
+func WithMonitorOnlyRoutes(routes RouteTemplates) EntitlementsOption {
+	return func(h *EntitlementsHandler) {
+		h.monitorRoutes = append(h.monitorRoutes, routes...)
+	}
+}
+
+// WithSubjectResolvers makes the handler establish the identity of the
+// subject of each request using the resolvers, rather than the User header.
+// The resolvers are tried in order, and the first to find credentials in
+// the request determines the subject, roles, groups and subject attributes
+// of the EntitlementsInput, along with the jwt field if the credentials
+// were a JWT. Requests with invalid credentials are rejected with 401
+// before OPA is consulted.
+//
+// If required is true, requests for which none of the resolvers find
+// credentials are also rejected, otherwise they are passed to OPA without a
+// subject. A UserHeaderResolver may be included in the chain to fall back
+// to the User header, but since anyone can set that header, doing so lets
+// clients without credentials act as any subject.
+func WithSubjectResolvers(required bool, resolvers ...SubjectResolver) EntitlementsOption {
+	return func(h *EntitlementsHandler) {
+		h.resolvers = resolvers
+		h.subjectRequired = required
+	}
+}
+
+// WithResourceAttributes makes the handler populate the resource-attributes
+// field of each EntitlementsInput using the function, including the inputs
+// used by ItemFilters. This allows policies to reason about the resource
+// itself, rather than just its path.
+func WithResourceAttributes(attributes ResourceAttributeFunc) EntitlementsOption {
+	return func(h *EntitlementsHandler) {
+		h.resourceAttributes = attributes
+	}
+}
+
+// WithRequestBodies makes the handler pass the body of requests matching
+// one of the routes to OPA, in the "body" sub-field of the Context field.
+// The body is buffered, so that the wrapped handler can still read it, and
+// parsed as JSON, since that is all the API accepts. Requests whose body is
+// larger than limit bytes are rejected with 413, and those whose body is not
+// valid JSON with 400, before OPA is consulted.
+func WithRequestBodies(routes RouteTemplates, limit int64) EntitlementsOption {
+	return func(h *EntitlementsHandler) {
+		h.bodyRoutes = append(h.bodyRoutes, routes...)
+		h.bodyLimit = limit
+	}
+}
+
+// WithDenyReasons makes the handler explain why requests were denied, by
+// including the decision ID, the decision type and the messages of the
+// enforced rules which denied the request in the body of 403 responses.
+// This is useful while developing a policy, but may reveal more about it
+// than is wanted in production.
+func WithDenyReasons() EntitlementsOption {
+	return func(h *EntitlementsHandler) {
+		h.denyReasons = true
+	}
+}
+
+// WithDecisionLog makes the handler record the decision made for each
+// request in the decision log, along with the status code the request was
+// answered with.
+func WithDecisionLog(logger *DecisionLogger) EntitlementsOption {
+	return func(h *EntitlementsHandler) {
+		h.decisionLog = logger
+	}
+}
+
+// WithRouteTemplates names the routes of the wrapped handler, so that the
+// entitlements_decisions_total metric can be labeled with the template of
+// the route each request matched, rather than its full path. Requests which
+// match none of them are labeled "unmatched".
+func WithRouteTemplates(routes RouteTemplates) EntitlementsOption {
+	return func(h *EntitlementsHandler) {
+		h.routes = append(h.routes, routes...)
+	}
+}
+
+// WithItemFiltering makes an ItemFilter available to the wrapped handler via
+// ItemFilterFromContext(), so that it can ask OPA about each individual item
+// in the lists it returns. The items are checked with the same input as the
+// request itself, except for the action and resource.
+func WithItemFiltering() EntitlementsOption {
+	return func(h *EntitlementsHandler) {
+		h.filterItems = true
+	}
+}
+
+// WithFieldEntitlements protects the given fields, such as "status.price",
+// so that the wrapped handler only lets subjects read or write them if they
+// have been granted access via the entz of the Entitlements result. The
+// FieldAccess of each request is made available via FieldAccessFromContext().
+func WithFieldEntitlements(protected []string) EntitlementsOption {
+	return func(h *EntitlementsHandler) {
+		h.protectedFields = protected
+	}
 }
 
 // NewEntitlementsHandler instances a new EntitlementsHandler.
-func NewEntitlementsHandler(decider OPADecider, handler http.Handler) *EntitlementsHandler {
-	return &EntitlementsHandler{
+func NewEntitlementsHandler(decider OPADecider, handler http.Handler, opts ...EntitlementsOption) *EntitlementsHandler {
+	h := &EntitlementsHandler{
 		decider: decider,
 		handler: handler,
 	}
+
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	if h.resolvers == nil {
+		h.resolvers = []SubjectResolver{UserHeaderResolver{}}
+	}
+
+	return h
 }
 
 func jsonError(w http.ResponseWriter, message string, err error, code int) {
@@ -99,8 +319,57 @@ func jsonError(w http.ResponseWriter, message string, err error, code int) {
 	http.Error(w, string(b), code)
 }
 
+// ErrDecisionTimeout is returned by an ItemFilter if the decisions it needs
+// take longer than the EntitlementsHandler's decision timeout.
+var ErrDecisionTimeout = errors.New("timed out waiting for decision")
+
+// decisionContext returns the context that decisions for the request should
+// be obtained with, applying the decision timeout if there is one.
+func (h *EntitlementsHandler) decisionContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if h.timeout > 0 {
+		return context.WithTimeout(r.Context(), h.timeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
+// timedOut returns true if err was caused by ctx's deadline. Not every
+// decider wraps the context's error, so the context is also checked.
+func timedOut(ctx context.Context, err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded)
+}
+
+// opaFailed returns true if err was caused by OPA failing to respond, or
+// responding with an error, as opposed to a problem with the request.
+func opaFailed(err error) bool {
+	var statusErr *OPAStatusError
+	var urlErr *url.Error
+	return errors.As(err, &statusErr) || errors.As(err, &urlErr)
+}
+
 // ServeHTTP implements http.Handler.ServeHTTP
 func (h *EntitlementsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	// Continue the caller's trace, if it sent one.
+	traceCtx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	traceCtx, span := tracer.Start(traceCtx, "EntitlementsHandler.ServeHTTP",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(r.Method),
+			semconv.HTTPTargetKey.String(r.URL.Path),
+		),
+	)
+	r = r.WithContext(traceCtx)
+
+	recorder := &statusRecorder{ResponseWriter: w}
+	w = recorder
+	defer func() {
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(recorder.Status()))
+		if recorder.Status() >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(recorder.Status()))
+		}
+		span.End()
+	}()
 
 	entzContext := map[string]interface{}{}
 	entzContext["headers"] = r.Header
@@ -108,35 +377,445 @@ func (h *EntitlementsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	input := &EntitlementsInput{
 		Action:   r.Method,
 		Resource: r.URL.Path,
-		Subject:  r.Header.Get("User"),
 		Context:  entzContext,
 	}
 
-	decision, err := h.decider.Decision(input)
-	if err != nil {
+	if !h.authenticate(w, r, input) {
+		return
+	}
+	span.SetAttributes(semconv.EnduserIDKey.String(input.Subject))
+
+	if h.bodyRoutes.Matches(r) && !h.readBody(w, r, entzContext) {
+		return
+	}
+
+	if h.resourceAttributes != nil {
+		attributes, err := h.resourceAttributes(r.Context(), input.Resource)
+		if err != nil {
+			jsonError(w, "failed to look up resource attributes", err, 500)
+			return
+		}
+		input.ResourceAttribute = attributes
+	}
+
+	var record *DecisionLogRecord
+	if h.decisionLog != nil {
+		record = &DecisionLogRecord{
+			Timestamp: start.UTC(),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Subject:   input.Subject,
+			Input:     input,
+		}
+		defer h.logDecision(record, recorder, start)
+	}
+
+	result := "error"
+	defer func() {
+		entitlementsDecisions.WithLabelValues(r.Method, h.routeLabel(r), result).Inc()
+	}()
+
+	decisionStart := time.Now()
+	decisionCtx, cancel := h.decisionContext(r)
+	decision, err := h.decider.Decision(decisionCtx, input)
+	cancel()
+	if record != nil {
+		record.DecisionLatency = milliseconds(time.Since(decisionStart))
+		if err != nil {
+			record.Error = err.Error()
+		} else {
+			record.DecisionID = decision.ID
+			record.Source = decision.Source
+			record.Cached = decision.Cached
+			record.Result = decision.Result
+		}
+	}
+	if err != nil && timedOut(decisionCtx, err) {
+		log.Printf("%s %s %s: timed out waiting for decision: %v\n", r.RemoteAddr, r.Method, r.URL.Path, err)
+		jsonError(w, "timed out waiting for decision", err, 503)
+		return
+	} else if errors.Is(err, ErrCircuitOpen) {
+		log.Printf("%s %s %s: %v\n", r.RemoteAddr, r.Method, r.URL.Path, err)
+		jsonError(w, "OPA is unavailable", err, 503)
+		return
+	} else if opaFailed(err) {
+		jsonError(w, "failed to get decision from OPA", err, 502)
+		return
+	} else if err != nil {
 		jsonError(w, "failed to get decision for input", err, 500)
 		return
 	}
 
-	resultJSON, err := json.Marshal(decision.Result)
+	allowed, err := h.allowed(decision)
 	if err != nil {
-		jsonError(w, "failed to marshal decision result", err, 500)
+		jsonError(w, "failed to decode decision result", err, 500)
 		return
 	}
 
-	result := &EntitlementsResult{}
-	err = json.Unmarshal(resultJSON, result)
+	if record != nil {
+		record.Allowed = allowed
+	}
+
+	span.SetAttributes(
+		attribute.String("decision.id", decision.ID),
+		attribute.Bool("decision.allowed", allowed),
+	)
+
+	w.Header().Set("X-Decision-ID", decision.ID)
+	if decision.Source != "" {
+		w.Header().Set("X-Decision-Source", decision.Source)
+	}
+
+	monitor := h.monitorOnly(r)
+
+	if !allowed && monitor {
+		log.Printf("%s %s %s: would have been denied by decision %s, allowing since monitoring only\n", r.RemoteAddr, r.Method, r.URL.Path, describeDecision(decision))
+		logOutcome(r, decision)
+		w.Header().Set("X-Entitlements-Would-Deny", decision.ID)
+		result = "monitored_deny"
+	} else if !allowed {
+		log.Printf("%s %s %s: denied by decision %s\n", r.RemoteAddr, r.Method, r.URL.Path, describeDecision(decision))
+		logOutcome(r, decision)
+		h.deny(w, decision)
+		result = "deny"
+		return
+	} else {
+		log.Printf("%s %s %s: allowed by decision %s\n", r.RemoteAddr, r.Method, r.URL.Path, describeDecision(decision))
+		result = "allow"
+	}
+
+	ctx := r.Context()
+
+	author := Author{Subject: input.Subject, DecisionID: decision.ID}
+	ctx = context.WithValue(ctx, authorContextKey{}, author)
+
+	if h.filterItems {
+		ctx = context.WithValue(ctx, itemFilterContextKey{}, h.itemFilter(r, input, monitor))
+	}
+
+	if len(h.protectedFields) > 0 {
+		result, err := decodeResult(decision)
+		if err != nil {
+			jsonError(w, "failed to decode decision result", err, 500)
+			return
+		}
+
+		access := newFieldAccess(h.protectedFields, resultEntz(result))
+		ctx = context.WithValue(ctx, fieldAccessContextKey{}, access)
+	}
+
+	h.handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// authenticate establishes the identity of the request's subject using the
+// first SubjectResolver which finds credentials in it, and fills in the
+// input from the identity. If the request may not proceed, it writes a 401
+// response and returns false.
+func (h *EntitlementsHandler) authenticate(w http.ResponseWriter, r *http.Request, input *EntitlementsInput) bool {
+	for _, resolver := range h.resolvers {
+		id, err := resolver.ResolveSubject(r)
+		if err != nil {
+			log.Printf("%s %s %s: rejecting credentials: %v\n", r.RemoteAddr, r.Method, r.URL.Path, err)
+			if challenge := resolver.Challenge(); challenge != "" {
+				w.Header().Set("WWW-Authenticate", challenge)
+			}
+			jsonError(w, "invalid credentials", err, 401)
+			return false
+		}
+
+		if id == nil {
+			continue
+		}
+
+		input.JWT = id.JWT
+		input.Subject = id.Subject
+		input.Roles = id.Roles
+		input.Groups = id.Groups
+		input.SubjectAttributes = id.Attributes
+		return true
+	}
+
+	if !h.subjectRequired {
+		return true
+	}
+
+	for _, resolver := range h.resolvers {
+		if challenge := resolver.Challenge(); challenge != "" {
+			w.Header().Add("WWW-Authenticate", challenge)
+		}
+	}
+	jsonError(w, "authentication required", nil, 401)
+	return false
+}
+
+// routeLabel returns the template of the route the request matched, for use
+// as a metric label.
+func (h *EntitlementsHandler) routeLabel(r *http.Request) string {
+	route, ok := h.routes.Match(r)
+	if !ok {
+		return "unmatched"
+	}
+	return route.Path()
+}
+
+// milliseconds converts the duration to fractional milliseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// logDecision completes the decision log record once the request has been
+// answered, and writes it to the decision log.
+func (h *EntitlementsHandler) logDecision(record *DecisionLogRecord, recorder *statusRecorder, start time.Time) {
+	record.Status = recorder.Status()
+	record.RequestDuration = milliseconds(time.Since(start))
+
+	err := h.decisionLog.Log(record)
+	if err != nil {
+		log.Printf("failed to write decision log: %v\n", err)
+	}
+}
+
+// readBody buffers the request's body, replacing r.Body so that it can be
+// read again by the wrapped handler, and puts the parsed body into the
+// entitlements context. If the request may not proceed, it writes an error
+// response and returns false.
+func (h *EntitlementsHandler) readBody(w http.ResponseWriter, r *http.Request, entzContext map[string]interface{}) bool {
+	// Read one byte more than the limit, to tell whether it was exceeded.
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, h.bodyLimit+1))
+	r.Body.Close()
+	if err != nil {
+		jsonError(w, "failed to read request body", err, 400)
+		return false
+	}
+
+	if int64(len(body)) > h.bodyLimit {
+		jsonError(w, fmt.Sprintf("request body is larger than %d bytes", h.bodyLimit), nil, 413)
+		return false
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		return true
+	}
+
+	var parsed interface{}
+	err = json.Unmarshal(body, &parsed)
 	if err != nil {
-		jsonError(w, "failed to unmarshal decision result", err, 500)
+		jsonError(w, "failed to parse request body", err, 400)
+		return false
+	}
+
+	entzContext["body"] = parsed
+	return true
+}
+
+// denial is the body of the 403 response for a denied request, if
+// WithDenyReasons is used. It extends the body written by jsonError.
+type denial struct {
+	Msg          string   `json:"msg"`
+	Err          string   `json:"err"`
+	DecisionID   string   `json:"decision_id"`
+	DecisionType string   `json:"decision_type,omitempty"`
+	Reasons      []string `json:"reasons,omitempty"`
+}
+
+// deny writes the 403 response for a request which the decision denied.
+func (h *EntitlementsHandler) deny(w http.ResponseWriter, decision *OPADecision) {
+	const message = "action prohibited by Entitlements policy"
+	if !h.denyReasons {
+		jsonError(w, message, nil, 403)
 		return
 	}
 
-	if !result.Allowed {
-		log.Printf("%s %s %s: denied by decision %s\n", r.RemoteAddr, r.Method, r.URL.Path, decision.ID)
-		jsonError(w, "action prohibited by Entitlements policy", nil, 403)
+	body := &denial{
+		Msg:        message,
+		DecisionID: decision.ID,
+	}
+
+	result, err := decodeResult(decision)
+	if err == nil && result.Outcome != nil {
+		body.DecisionType = result.Outcome.DecisionType
+		for _, rule := range result.Outcome.Enforced {
+			if rule != nil && rule.Denied && rule.Message != "" {
+				body.Reasons = append(body.Reasons, rule.Message)
+			}
+		}
+	}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		// should never happen
+		panic(fmt.Sprintf("error while marshaling '%v': %v\n", body, err))
+	}
+
+	http.Error(w, string(b), 403)
+}
+
+// monitorOnly returns true if denials of the request should be logged rather
+// than enforced.
+func (h *EntitlementsHandler) monitorOnly(r *http.Request) bool {
+	return h.monitorAll || h.monitorRoutes.Matches(r)
+}
+
+// logOutcome logs the results of the enforced and monitored rules of an
+// Entitlements decision, if it has an outcome.
+func logOutcome(r *http.Request, decision *OPADecision) {
+	result, err := decodeResult(decision)
+	if err != nil || result.Outcome == nil {
 		return
 	}
 
-	log.Printf("%s %s %s: allowed by decision %s\n", r.RemoteAddr, r.Method, r.URL.Path, decision.ID)
-	h.handler.ServeHTTP(w, r)
+	rules := func(kind string, results []*EntitlementsRuleResult) {
+		for _, rule := range results {
+			if rule == nil {
+				continue
+			}
+
+			verdict := "matched"
+			if rule.Denied {
+				verdict = "denied"
+			} else if rule.Allowed {
+				verdict = "allowed"
+			}
+			log.Printf("%s %s %s: %s rule %s: %s\n", r.RemoteAddr, r.Method, r.URL.Path, kind, verdict, rule.Message)
+		}
+	}
+
+	rules("enforced", result.Outcome.Enforced)
+	rules("monitored", result.Outcome.Monitored)
+}
+
+// describeDecision identifies the decision in log messages, including the
+// decider which made it if it is known.
+func describeDecision(decision *OPADecision) string {
+	if decision.Source == "" {
+		return decision.ID
+	}
+	return fmt.Sprintf("%s from '%s'", decision.ID, decision.Source)
+}
+
+// allowed returns true if the decision allows the request.
+func (h *EntitlementsHandler) allowed(decision *OPADecision) (bool, error) {
+	if h.allowPath == nil {
+		result, err := decodeResult(decision)
+		if err != nil {
+			return false, err
+		}
+
+		return result.Allowed, nil
+	}
+
+	value, ok := h.allowPath.Lookup(decision.Result)
+	if !ok {
+		return false, fmt.Errorf("result of decision %s does not contain allow path '%s'", decision.ID, h.allowPath)
+	}
+
+	allowed, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("value at allow path '%s' in result of decision %s is not a boolean", h.allowPath, decision.ID)
+	}
+
+	return allowed, nil
+}
+
+// decodeResult decodes the result of an OPA decision as an
+// EntitlementsResult. Results which are not objects, such as those of
+// policies which return a bare boolean, decode as an empty
+// EntitlementsResult.
+func decodeResult(decision *OPADecision) (*EntitlementsResult, error) {
+	if _, ok := decision.Result.(map[string]interface{}); !ok {
+		return &EntitlementsResult{}, nil
+	}
+
+	resultJSON, err := json.Marshal(decision.Result)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &EntitlementsResult{}
+	err = json.Unmarshal(resultJSON, result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// resultEntz collects the entz of an Entitlements result, along with those of
+// each enforced rule which allowed it.
+func resultEntz(result *EntitlementsResult) []interface{} {
+	entz := appendEntz(nil, result.Entz)
+	if result.Outcome != nil {
+		for _, rule := range result.Outcome.Enforced {
+			if rule != nil && rule.Allowed {
+				entz = appendEntz(entz, rule.Entz)
+			}
+		}
+	}
+	return entz
+}
+
+// appendEntz appends the entz, which may be a single value or a list, to the
+// slice.
+func appendEntz(entz []interface{}, value interface{}) []interface{} {
+	switch v := value.(type) {
+	case nil:
+		return entz
+	case []interface{}:
+		return append(entz, v...)
+	default:
+		return append(entz, v)
+	}
+}
+
+// itemFilter creates the ItemFilter for a request, given the input that was
+// used to authorize the request itself. If monitor is true, denied items are
+// logged but not filtered out.
+func (h *EntitlementsHandler) itemFilter(r *http.Request, input *EntitlementsInput, monitor bool) ItemFilter {
+	return func(action string, resources []string) ([]bool, error) {
+		inputs := make([]interface{}, len(resources))
+		for i, resource := range resources {
+			itemInput := *input
+			itemInput.Action = action
+			itemInput.Resource = resource
+			if h.resourceAttributes != nil {
+				attributes, err := h.resourceAttributes(r.Context(), resource)
+				if err != nil {
+					return nil, err
+				}
+				itemInput.ResourceAttribute = attributes
+			}
+			inputs[i] = &itemInput
+		}
+
+		ctx, cancel := h.decisionContext(r)
+		defer cancel()
+
+		decisions, err := Decisions(ctx, h.decider, inputs)
+		if err != nil && timedOut(ctx, err) {
+			return nil, fmt.Errorf("%w: %v", ErrDecisionTimeout, err)
+		} else if err != nil {
+			return nil, err
+		}
+
+		allowed := make([]bool, len(resources))
+		for i, decision := range decisions {
+			allowed[i], err = h.allowed(decision)
+			if err != nil {
+				return nil, err
+			}
+
+			verdict := "denied"
+			if allowed[i] {
+				verdict = "allowed"
+			} else if monitor {
+				verdict = "would have been denied"
+				allowed[i] = true
+			}
+			log.Printf("%s %s %s: item %s %s %s by decision %s\n", r.RemoteAddr, r.Method, r.URL.Path, action, resources[i], verdict, describeDecision(decision))
+		}
+
+		return allowed, nil
+	}
 }
@@ -0,0 +1,127 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Assert compliance with OPADecider and BatchOPADecider
+var _ OPADecider = (*FallbackDecider)(nil)
+var _ BatchOPADecider = (*FallbackDecider)(nil)
+
+// NamedDecider is an OPADecider along with a name to identify it by, such as
+// the mode it was configured with.
+type NamedDecider struct {
+	Name    string
+	Decider OPADecider
+}
+
+// FallbackDecider consults each of a list of OPADeciders in turn, until one
+// of them returns a decision rather than an error. This allows, for example,
+// an OPA sidecar to be used if the embedded SDK fails, with a static policy as
+// a last resort.
+//
+// The Source of each decision is set to the name of the decider which
+// returned it, and the time each decider takes is recorded in the
+// entitlements_decision_duration_seconds metric under the same name.
+type FallbackDecider struct {
+	chain []NamedDecider
+}
+
+// NewFallbackDecider instances an OPADecider which consults the given
+// deciders in order.
+func NewFallbackDecider(chain ...NamedDecider) OPADecider {
+	return &FallbackDecider{
+		chain: chain,
+	}
+}
+
+// withSource returns a copy of the decision, with the Source set. Deciders
+// may return the same decision more than once, e.g. if it is cached, so it
+// is not modified in place.
+func withSource(decision *OPADecision, source string) *OPADecision {
+	copied := *decision
+	copied.Source = source
+	return &copied
+}
+
+// fallbackError combines the errors from each decider in the chain. The last
+// error is wrapped, so that callers can still tell e.g. whether the final
+// decider's circuit breaker was open.
+func fallbackError(failures []string, err error) error {
+	return fmt.Errorf("all deciders failed (%s): %w", strings.Join(failures, "; "), err)
+}
+
+// Decision implements OPADecider.Decision.
+func (f *FallbackDecider) Decision(ctx context.Context, input interface{}) (*OPADecision, error) {
+	var err error
+	failures := []string{}
+	for i, d := range f.chain {
+		var decision *OPADecision
+		start := time.Now()
+		decision, err = d.Decider.Decision(ctx, input)
+		observeDecision(d.Name, start, err)
+		if err == nil {
+			return withSource(decision, d.Name), nil
+		}
+
+		failures = append(failures, fmt.Sprintf("%s: %v", d.Name, err))
+
+		// If we have run out of time, so will the rest of the chain.
+		if ctx.Err() != nil {
+			break
+		}
+
+		if i+1 < len(f.chain) {
+			log.Printf("decider '%s' failed, falling back to '%s': %v\n", d.Name, f.chain[i+1].Name, err)
+		}
+	}
+
+	if err == nil {
+		return nil, fmt.Errorf("no deciders configured")
+	}
+
+	return nil, fallbackError(failures, err)
+}
+
+// Decisions implements BatchOPADecider.Decisions. The whole batch is
+// obtained from a single decider.
+func (f *FallbackDecider) Decisions(ctx context.Context, inputs []interface{}) ([]*OPADecision, error) {
+	var err error
+	failures := []string{}
+	for i, d := range f.chain {
+		var decisions []*OPADecision
+		start := time.Now()
+		decisions, err = Decisions(ctx, d.Decider, inputs)
+		observeDecision(d.Name, start, err)
+		if err == nil {
+			for j := range decisions {
+				decisions[j] = withSource(decisions[j], d.Name)
+			}
+			return decisions, nil
+		}
+
+		failures = append(failures, fmt.Sprintf("%s: %v", d.Name, err))
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		if i+1 < len(f.chain) {
+			log.Printf("decider '%s' failed, falling back to '%s': %v\n", d.Name, f.chain[i+1].Name, err)
+		}
+	}
+
+	if err == nil {
+		return nil, fmt.Errorf("no deciders configured")
+	}
+
+	return nil, fallbackError(failures, err)
+}
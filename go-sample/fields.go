@@ -0,0 +1,266 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+//
+// This file implements field-level entitlements. The server is configured
+// with a list of "protected" fields, such as "status.price". Protected fields
+// are only visible to, and may only be written by, subjects which have been
+// granted access to them via the entz returned by the Entitlements policy.
+// Fields which are not protected are unaffected.
+//
+// Grants are strings of the form "<access>:<resource>.<field>", where access
+// is either "read" or "write" (which implies read), and field may be "*" to
+// match every field of the resource. For example, this rule only lets sales
+// managers see prices:
+//
+//	enforce[decision] {
+//	  #title: sales managers may see prices
+//	  input.subject == "alice"
+//	  decision := {
+//	    "allowed": true,
+//	    "entz": {"read:status.price"},
+//	    "message": "alice is a sales manager"
+//	  }
+//	}
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// FieldAccess describes which protected fields a subject may read and write.
+type FieldAccess struct {
+	protected map[string]bool
+	read      map[string]bool
+	write     map[string]bool
+}
+
+// newFieldAccess creates a FieldAccess for the given protected fields,
+// granting access according to the grants. Grants which are not strings, or
+// which are not of the form described above, are ignored.
+func newFieldAccess(protected []string, grants []interface{}) *FieldAccess {
+	f := &FieldAccess{
+		protected: map[string]bool{},
+		read:      map[string]bool{},
+		write:     map[string]bool{},
+	}
+
+	for _, field := range protected {
+		f.protected[field] = true
+	}
+
+	for _, grant := range grants {
+		s, ok := grant.(string)
+		if !ok {
+			continue
+		}
+
+		access, field, ok := strings.Cut(s, ":")
+		if !ok {
+			continue
+		}
+
+		switch access {
+		case "write":
+			f.write[field] = true
+			f.read[field] = true
+		case "read":
+			f.read[field] = true
+		}
+	}
+
+	return f
+}
+
+// granted returns true if the grants contain the field, or a wildcard for
+// the field's resource.
+func granted(grants map[string]bool, resource, field string) bool {
+	return grants[resource+"."+field] || grants[resource+".*"]
+}
+
+// CanRead returns true if the subject may see the field of the resource.
+func (f *FieldAccess) CanRead(resource, field string) bool {
+	return !f.protected[resource+"."+field] || granted(f.read, resource, field)
+}
+
+// CanWrite returns true if the subject may set the field of the resource.
+func (f *FieldAccess) CanWrite(resource, field string) bool {
+	return !f.protected[resource+"."+field] || granted(f.write, resource, field)
+}
+
+// fieldAccessContextKey is the context key under which EntitlementsHandler
+// stores the FieldAccess of each request it allows, if field-level
+// entitlements are enabled.
+type fieldAccessContextKey struct{}
+
+// FieldAccessFromContext returns the FieldAccess of a request which was
+// allowed by an EntitlementsHandler with field-level entitlements enabled,
+// given the request's context.
+func FieldAccessFromContext(ctx context.Context) (*FieldAccess, bool) {
+	access, ok := ctx.Value(fieldAccessContextKey{}).(*FieldAccess)
+	return access, ok
+}
+
+// FieldError is returned when a request body sets a field that the subject
+// is not entitled to write.
+type FieldError struct {
+	Resource string
+	Field    string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("not entitled to write field '%s.%s'", e.Resource, e.Field)
+}
+
+// Redact returns the JSON representation of value, as a map, with every
+// field that may not be read removed.
+func (f *FieldAccess) Redact(resource string, value interface{}) (map[string]interface{}, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]interface{}{}
+	err = json.Unmarshal(raw, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	for field := range fields {
+		if !f.CanRead(resource, field) {
+			delete(fields, field)
+		}
+	}
+
+	return fields, nil
+}
+
+// RedactRaw is like Redact, but for a JSON encoded value. JSON null is left
+// alone.
+func (f *FieldAccess) RedactRaw(resource string, raw json.RawMessage) (json.RawMessage, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return raw, nil
+	}
+
+	fields, err := f.Redact(resource, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(fields)
+}
+
+// jsonFieldNames returns the names of the fields of the JSON representation
+// of the type that target points to, which must not use omitempty.
+func jsonFieldNames(target interface{}) ([]string, error) {
+	zero := reflect.New(reflect.TypeOf(target).Elem()).Interface()
+	raw, err := json.Marshal(zero)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]json.RawMessage{}
+	err = json.Unmarshal(raw, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	return sortedKeys(fields), nil
+}
+
+// canonicalFields rekeys the fields of a JSON object which is to be decoded
+// into target by the names of the fields of target that they would set.
+// Keys are matched to fields the same way encoding/json does it, preferring
+// an exact match, but otherwise ignoring case, so that e.g. "Price" cannot
+// be used to set "price" without being checked. Keys which match no field
+// are dropped, since encoding/json would ignore them, and it is an error for
+// two keys to match the same field.
+func canonicalFields(fields map[string]json.RawMessage, target interface{}) (map[string]json.RawMessage, error) {
+	names, err := jsonFieldNames(target)
+	if err != nil {
+		return nil, err
+	}
+
+	canonical := map[string]json.RawMessage{}
+	for _, key := range sortedKeys(fields) {
+		name := ""
+		for _, candidate := range names {
+			if candidate == key {
+				name = candidate
+				break
+			}
+			if name == "" && strings.EqualFold(candidate, key) {
+				name = candidate
+			}
+		}
+
+		if name == "" {
+			continue
+		}
+
+		if _, ok := canonical[name]; ok {
+			return nil, fmt.Errorf("field '%s' is given more than once", name)
+		}
+		canonical[name] = fields[key]
+	}
+
+	return canonical, nil
+}
+
+// Merge decodes the JSON request body into target, which must be a pointer.
+// If the body sets any field that may not be written, a *FieldError is
+// returned. Fields which may not be written are instead copied from current,
+// which should be the value that is being replaced, or nil if there is none.
+func (f *FieldAccess) Merge(resource string, body []byte, current interface{}, target interface{}) error {
+	fields := map[string]json.RawMessage{}
+	err := json.Unmarshal(body, &fields)
+	if err != nil {
+		return err
+	}
+
+	fields, err = canonicalFields(fields, target)
+	if err != nil {
+		return err
+	}
+
+	for field := range fields {
+		if !f.CanWrite(resource, field) {
+			return &FieldError{Resource: resource, Field: field}
+		}
+	}
+
+	if current != nil {
+		raw, err := json.Marshal(current)
+		if err != nil {
+			return err
+		}
+
+		existing := map[string]json.RawMessage{}
+		err = json.Unmarshal(raw, &existing)
+		if err != nil {
+			return err
+		}
+
+		for field, value := range existing {
+			if !f.CanWrite(resource, field) {
+				fields[field] = value
+			}
+		}
+	}
+
+	merged, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(merged, target)
+}
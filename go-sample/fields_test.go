@@ -0,0 +1,125 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFieldAccessMergeRejectsProtectedFields(t *testing.T) {
+	access := newFieldAccess([]string{"status.price"}, nil)
+
+	for _, body := range []string{
+		`{"price": 5}`,
+		`{"Price": 5}`,
+		`{"PRICE": 5}`,
+		`{"pRiCe": 5}`,
+		`{"sold": true, "Price": 5}`,
+	} {
+		for _, current := range []interface{}{nil, &Status{Price: 10}} {
+			var status Status
+			err := access.Merge(HistoryStatus, []byte(body), current, &status)
+
+			var fieldErr *FieldError
+			if !errors.As(err, &fieldErr) {
+				t.Errorf("body %s, current %v: expected a FieldError, got %v (status %+v)", body, current, err, status)
+				continue
+			}
+			if fieldErr.Field != "price" {
+				t.Errorf("body %s: expected the error to name field 'price', got '%s'", body, fieldErr.Field)
+			}
+		}
+	}
+}
+
+func TestFieldAccessMergeAllowsGrantedFields(t *testing.T) {
+	access := newFieldAccess([]string{"status.price"}, []interface{}{"write:status.price"})
+
+	for _, body := range []string{`{"price": 5}`, `{"Price": 5}`} {
+		var status Status
+		err := access.Merge(HistoryStatus, []byte(body), &Status{Price: 10}, &status)
+		if err != nil {
+			t.Fatalf("body %s: unexpected error: %v", body, err)
+		}
+		if status.Price != 5 {
+			t.Errorf("body %s: expected price 5, got %v", body, status.Price)
+		}
+	}
+}
+
+func TestFieldAccessMergeCarriesOverProtectedFields(t *testing.T) {
+	access := newFieldAccess([]string{"status.price"}, nil)
+
+	var status Status
+	err := access.Merge(HistoryStatus, []byte(`{"Sold": true}`), &Status{Ready: true, Price: 10}, &status)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := Status{Sold: true, Price: 10}
+	if status != expected {
+		t.Errorf("expected %+v, got %+v", expected, status)
+	}
+}
+
+func TestFieldAccessMergeIgnoresNestedKeys(t *testing.T) {
+	access := newFieldAccess([]string{"status.price"}, nil)
+
+	for _, body := range []string{
+		`{"status": {"price": 5}}`,
+		`{"sold": true, "status.price": 5}`,
+		`{"nested": {"Price": 5}}`,
+	} {
+		var status Status
+		err := access.Merge(HistoryStatus, []byte(body), nil, &status)
+		if err != nil {
+			t.Errorf("body %s: unexpected error: %v", body, err)
+			continue
+		}
+		if status.Price != 0 {
+			t.Errorf("body %s: protected field was set: %+v", body, status)
+		}
+	}
+}
+
+func TestFieldAccessMergeRejectsDuplicateFields(t *testing.T) {
+	access := newFieldAccess([]string{"status.price"}, []interface{}{"write:status.price"})
+
+	var status Status
+	err := access.Merge(HistoryStatus, []byte(`{"price": 5, "PRICE": 6}`), nil, &status)
+	if err == nil {
+		t.Fatalf("expected an error, got status %+v", status)
+	}
+
+	var fieldErr *FieldError
+	if errors.As(err, &fieldErr) {
+		t.Errorf("expected a decoding error rather than a FieldError, got %v", err)
+	}
+}
+
+func TestFieldAccessRedact(t *testing.T) {
+	access := newFieldAccess([]string{"status.price"}, nil)
+
+	fields, err := access.Redact(HistoryStatus, Status{Sold: true, Price: 10})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := fields["price"]; ok {
+		t.Errorf("expected price to be redacted, got %v", fields)
+	}
+	if fields["sold"] != true {
+		t.Errorf("expected sold to be kept, got %v", fields)
+	}
+
+	access = newFieldAccess([]string{"status.price"}, []interface{}{"read:status.*"})
+	fields, err = access.Redact(HistoryStatus, Status{Price: 10})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := fields["price"]; !ok {
+		t.Errorf("expected price to be readable via the wildcard grant, got %v", fields)
+	}
+}
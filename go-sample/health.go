@@ -0,0 +1,230 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/opa/plugins/bundle"
+	"github.com/open-policy-agent/opa/sdk"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+//
+// This file defines the liveness, readiness and policy status endpoints. The
+// liveness endpoint only shows that the server is answering requests, while
+// the readiness endpoint runs a ReadinessChecker for each of the things the
+// server needs before it can usefully answer API requests, such as an
+// activated policy bundle and a loaded store.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// readinessTimeout bounds how long each ReadinessChecker may take.
+const readinessTimeout = 2 * time.Second
+
+// ReadinessChecker is implemented by things which the server depends on, and
+// which may not be ready to use as soon as the server starts.
+type ReadinessChecker interface {
+	// Ready returns an error describing why the dependency is not ready,
+	// or nil if it is.
+	Ready(ctx context.Context) error
+}
+
+// ReadinessCheckFunc adapts a function to the ReadinessChecker interface.
+type ReadinessCheckFunc func(ctx context.Context) error
+
+// Ready implements ReadinessChecker.Ready.
+func (f ReadinessCheckFunc) Ready(ctx context.Context) error {
+	return f(ctx)
+}
+
+// StoreReadiness returns a ReadinessChecker which is ready once the store
+// can be read from.
+func StoreReadiness(store CarStore) ReadinessChecker {
+	return ReadinessCheckFunc(func(ctx context.Context) error {
+		_, err := store.GetCarIDs()
+		return err
+	})
+}
+
+// GetLivenessHandler returns a handler which always reports that the server
+// is alive, for use as a liveness probe.
+func GetLivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	})
+}
+
+// readiness is the body of a readiness response. Checks maps the name of
+// each check to "ok", or to the reason it is not ready.
+type readiness struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// GetReadinessHandler returns a handler which runs each of the named
+// checks, and reports the result of each as JSON, responding with 503 unless
+// all of them are ready.
+func GetReadinessHandler(checks map[string]ReadinessChecker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+
+		result := readiness{Ready: true, Checks: map[string]string{}}
+		for name, check := range checks {
+			err := check.Ready(ctx)
+			if err != nil {
+				result.Ready = false
+				result.Checks[name] = err.Error()
+			} else {
+				result.Checks[name] = "ok"
+			}
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		if !result.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+}
+
+// BundleStatus describes the state of a single policy bundle used by the
+// embedded OPA.
+type BundleStatus struct {
+	Name           string `json:"name"`
+	ActiveRevision string `json:"active_revision,omitempty"`
+
+	LastSuccessfulDownload   *time.Time `json:"last_successful_download,omitempty"`
+	LastSuccessfulActivation *time.Time `json:"last_successful_activation,omitempty"`
+
+	// LastError is the most recent error downloading or activating the
+	// bundle, which is kept after later attempts succeed.
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+}
+
+// PolicyStatus keeps track of the bundles used by the embedded OPA, and
+// whether it is ready to make decisions.
+type PolicyStatus struct {
+	ready <-chan struct{}
+
+	mutex   sync.Mutex
+	bundles map[string]*BundleStatus
+}
+
+// Assert compliance with ReadinessChecker
+var _ ReadinessChecker = (*PolicyStatus)(nil)
+
+// NewPolicyStatus starts keeping track of the bundles used by the embedded
+// OPA. The ready channel should be the one passed to sdk.New in
+// sdk.Options.Ready, which is closed once OPA has activated its bundles.
+func NewPolicyStatus(opa *sdk.OPA, ready <-chan struct{}) *PolicyStatus {
+	s := &PolicyStatus{
+		ready:   ready,
+		bundles: map[string]*BundleStatus{},
+	}
+
+	plugin, ok := opa.Plugin("bundle").(*bundle.Plugin)
+	if ok {
+		plugin.Register("policy_status", s.update)
+	}
+
+	return s
+}
+
+// timePtr returns a pointer to t, or nil if t is the zero time.
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// update records a status reported by the bundle plugin.
+func (s *PolicyStatus) update(status bundle.Status) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	b, ok := s.bundles[status.Name]
+	if !ok {
+		b = &BundleStatus{Name: status.Name}
+		s.bundles[status.Name] = b
+	}
+
+	b.ActiveRevision = status.ActiveRevision
+	b.LastSuccessfulDownload = timePtr(status.LastSuccessfulDownload)
+	b.LastSuccessfulActivation = timePtr(status.LastSuccessfulActivation)
+
+	if status.Code != "" || len(status.Errors) > 0 {
+		messages := []string{}
+		if status.Message != "" {
+			messages = append(messages, status.Message)
+		}
+		for _, err := range status.Errors {
+			messages = append(messages, err.Error())
+		}
+
+		b.LastError = strings.Join(messages, ": ")
+		b.LastErrorTime = timePtr(status.LastRequest)
+		if b.LastErrorTime == nil {
+			b.LastErrorTime = timePtr(time.Now())
+		}
+	}
+}
+
+// Ready implements ReadinessChecker.Ready. The embedded OPA is ready once it
+// has activated each of its bundles.
+func (s *PolicyStatus) Ready(ctx context.Context) error {
+	select {
+	case <-s.ready:
+		return nil
+	default:
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, name := range sortedKeys(s.bundles) {
+		if err := s.bundles[name].LastError; err != "" {
+			return errors.New("policy bundles have not been activated yet, last error: " + err)
+		}
+	}
+	return errors.New("policy bundles have not been activated yet")
+}
+
+// Bundles returns the status of each bundle, sorted by name.
+func (s *PolicyStatus) Bundles() []BundleStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	bundles := []BundleStatus{}
+	for _, name := range sortedKeys(s.bundles) {
+		bundles = append(bundles, *s.bundles[name])
+	}
+	return bundles
+}
+
+// GetPolicyStatusHandler returns a handler which reports whether the
+// embedded OPA is ready, and the status of each of its bundles, as JSON.
+func GetPolicyStatusHandler(status *PolicyStatus) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Ready   bool           `json:"ready"`
+			Bundles []BundleStatus `json:"bundles"`
+		}{
+			Ready:   status.Ready(r.Context()) == nil,
+			Bundles: status.Bundles(),
+		})
+	})
+}
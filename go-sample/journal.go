@@ -0,0 +1,161 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// Journal operations. Each of these corresponds to one of the mutating
+// CarStore methods.
+const (
+	journalSetCar    = "set-car"
+	journalDeleteCar = "delete-car"
+	journalSetStatus = "set-status"
+)
+
+// journalEntry represents a single mutation recorded in the journal. The
+// journal is stored as JSONL, with one entry per line.
+//
+// Sequence numbers entries in the order they were journaled, and unlike the
+// journal itself is never reset, so that replay can skip entries which are
+// already captured in the snapshot.
+type journalEntry struct {
+	Op       string         `json:"op"`
+	ID       string         `json:"id"`
+	Sequence uint64         `json:"seq,omitempty"`
+	Revision uint64         `json:"revision,omitempty"`
+	Car      *Car           `json:"car,omitempty"`
+	Status   *Status        `json:"status,omitempty"`
+	History  []HistoryEntry `json:"history,omitempty"`
+}
+
+// journal is an append-only log of mutations which have been applied since
+// the last snapshot was written. Every append is fsynced before it returns,
+// so once a mutation has been journaled it will survive a crash.
+type journal struct {
+	file *os.File
+
+	// entries is the number of entries in the journal.
+	entries int
+}
+
+// openJournal opens the journal at the given path for appending, creating it
+// if needed.
+func openJournal(path string) (*journal, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &journal{file: f}, nil
+}
+
+// append writes the entry to the journal and fsyncs it. If either fails, the
+// journal is truncated back to where it was, so that a partially written
+// entry is not left for the next append to be joined onto.
+func (j *journal) append(e *journalEntry) error {
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	offset, err := j.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	_, err = j.file.Write(append(raw, '\n'))
+	if err == nil {
+		err = j.file.Sync()
+	}
+
+	if err != nil {
+		if terr := j.file.Truncate(offset); terr != nil {
+			log.Printf("failed to discard partial entry from journal: %v\n", terr)
+		}
+		return err
+	}
+
+	j.entries++
+	return nil
+}
+
+// truncate discards all entries in the journal. This should only be done
+// once the entries have been captured in a snapshot.
+func (j *journal) truncate() error {
+	err := j.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	err = j.file.Sync()
+	if err != nil {
+		return err
+	}
+
+	j.entries = 0
+	return nil
+}
+
+func (j *journal) close() error {
+	return j.file.Close()
+}
+
+// replayJournal calls apply on every entry in the journal at the given path,
+// in order, and returns the number of entries replayed. A journal which does
+// not exist is treated as empty.
+//
+// If the final line of the journal is incomplete, which happens if we crash
+// partway through an append, it is discarded. Such a mutation was never
+// acknowledged, since the append did not return.
+func replayJournal(path string, apply func(e *journalEntry) error) (int, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	count := 0
+	offset := int64(0)
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				log.Printf("discarding incomplete entry at end of journal '%s'\n", path)
+				if err := f.Truncate(offset); err != nil {
+					return count, err
+				}
+			}
+			return count, nil
+		} else if err != nil {
+			return count, err
+		}
+
+		e := &journalEntry{}
+		err = json.Unmarshal(line, e)
+		if err != nil {
+			return count, fmt.Errorf("corrupt journal entry at offset %d of '%s': %w", offset, path, err)
+		}
+
+		err = apply(e)
+		if err != nil {
+			return count, fmt.Errorf("failed to replay journal entry at offset %d of '%s': %w", offset, path, err)
+		}
+
+		offset += int64(len(line))
+		count++
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestJournalAppendDiscardsPartialEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json.journal")
+
+	j, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.close()
+
+	err = j.append(&journalEntry{Op: journalDeleteCar, ID: "car0", Sequence: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := j.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Limit the size of files, so that the next append is only partly
+	// written. The Go runtime ignores the resulting SIGXFSZ, so the
+	// write fails with EFBIG instead.
+	var limit syscall.Rlimit
+	err = syscall.Getrlimit(syscall.RLIMIT_FSIZE, &limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = syscall.Setrlimit(syscall.RLIMIT_FSIZE, &syscall.Rlimit{Cur: uint64(size) + 16, Max: limit.Max})
+	if err != nil {
+		t.Skipf("cannot limit file size: %v", err)
+	}
+
+	err = j.append(&journalEntry{Op: journalSetCar, ID: "car1", Sequence: 2, Car: &Car{Make: strings.Repeat("x", 64)}})
+
+	if rerr := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &limit); rerr != nil {
+		t.Fatal(rerr)
+	}
+
+	if err == nil {
+		t.Fatal("expected the append to fail")
+	}
+	if j.entries != 1 {
+		t.Errorf("expected the failed append not to be counted, got %d entries", j.entries)
+	}
+
+	err = j.append(&journalEntry{Op: journalDeleteCar, ID: "car2", Sequence: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replayed := replayAll(t, path)
+	if len(replayed) != 2 || replayed[0].ID != "car0" || replayed[1].ID != "car2" {
+		t.Errorf("expected entries for car0 and car2, got %+v", replayed)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// replayAll returns every entry replayed from the journal at path.
+func replayAll(t *testing.T, path string) []*journalEntry {
+	t.Helper()
+
+	entries := []*journalEntry{}
+	count, err := replayJournal(path, func(e *journalEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(entries) {
+		t.Errorf("replayJournal returned %d, but replayed %d entries", count, len(entries))
+	}
+
+	return entries
+}
+
+func TestJournalAppendAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json.journal")
+
+	j, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	appended := []*journalEntry{
+		{Op: journalSetCar, ID: "car0", Sequence: 1, Revision: 1, Car: &Car{Make: "Honda"}},
+		{Op: journalSetStatus, ID: "car0", Sequence: 2, Revision: 2, Status: &Status{Price: 5}},
+		{Op: journalDeleteCar, ID: "car0", Sequence: 3},
+	}
+	for _, e := range appended {
+		if err := j.append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if j.entries != len(appended) {
+		t.Errorf("expected %d entries, got %d", len(appended), j.entries)
+	}
+
+	if replayed := replayAll(t, path); !reflect.DeepEqual(replayed, appended) {
+		t.Errorf("expected %+v, got %+v", appended, replayed)
+	}
+
+	err = j.truncate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Appends after a truncate must start from the beginning again.
+	err = j.append(appended[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed := replayAll(t, path); !reflect.DeepEqual(replayed, appended[:1]) {
+		t.Errorf("expected %+v after truncate, got %+v", appended[:1], replayed)
+	}
+
+	err = j.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJournalReplayMissing(t *testing.T) {
+	if replayed := replayAll(t, filepath.Join(t.TempDir(), "missing")); len(replayed) != 0 {
+		t.Errorf("expected no entries, got %+v", replayed)
+	}
+}
+
+func TestJournalReplayDiscardsIncompleteEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json.journal")
+	complete := `{"op":"delete-car","id":"car0","seq":1}` + "\n"
+
+	err := os.WriteFile(path, []byte(complete+`{"op":"set-car","id":"ca`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if replayed := replayAll(t, path); len(replayed) != 1 || replayed[0].ID != "car0" {
+		t.Errorf("expected only the complete entry, got %+v", replayed)
+	}
+
+	// The incomplete entry is removed, so that it can't be joined onto
+	// by the next append.
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != complete {
+		t.Errorf("expected the incomplete entry to be truncated, got %q", raw)
+	}
+}
+
+func TestJournalReplayRejectsCorruptEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json.journal")
+
+	err := os.WriteFile(path, []byte("{\"op\":\"delete-car\",\"id\":\"car0\"}\nnot json\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = replayJournal(path, func(e *journalEntry) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "corrupt journal entry") {
+		t.Errorf("expected a corrupt entry error, got %v", err)
+	}
+}
@@ -0,0 +1,586 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	// Register the hash functions used by the supported algorithms.
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+//
+// This file implements verification of JWT bearer tokens, so that the
+// subject of each request can be authenticated before OPA is asked whether
+// it is allowed. Tokens are verified either with a shared HMAC secret, or
+// with public keys loaded from a local JWKS file. Only the standard library
+// is used, and only the JWS compact serialization is supported.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// ErrInvalidToken is wrapped by every error returned by JWTVerifier.Verify.
+var ErrInvalidToken = errors.New("invalid token")
+
+// JWTClaims configures which claims of a token are used to populate the
+// EntitlementsInput. Each may be a top-level claim name, or a path into a
+// nested claim as accepted by ParseResultPath, e.g. "realm_access.roles".
+type JWTClaims struct {
+	// Subject is the claim holding the subject, usually "sub".
+	Subject string
+
+	// Roles and Groups are claims holding a list of strings, or a
+	// single string. They may be empty if tokens do not include them.
+	Roles  string
+	Groups string
+
+	// Attributes are claims which are copied into the subject
+	// attributes, keyed by the claim name. Values which are not strings
+	// are JSON encoded.
+	Attributes []string
+
+	// Issuer and Audience, if not empty, must match the "iss" claim and
+	// one of the "aud" claims of every token.
+	Issuer   string
+	Audience string
+
+	// AllowNoExpiry accepts tokens without an "exp" claim, which are
+	// otherwise rejected, since they would be valid forever.
+	AllowNoExpiry bool
+}
+
+// jwk is a single key from a JWKS.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+
+	// oct
+	K string `json:"k"`
+}
+
+// verificationKey is a key that tokens may be signed with. key is an
+// *rsa.PublicKey, an *ecdsa.PublicKey, or a []byte HMAC secret.
+type verificationKey struct {
+	kid string
+	alg string
+	key interface{}
+}
+
+// JWTVerifier verifies JWT bearer tokens and extracts the identity they
+// establish.
+type JWTVerifier struct {
+	keys   []verificationKey
+	claims JWTClaims
+
+	// leeway allows for clock skew when checking "exp" and "nbf".
+	leeway time.Duration
+}
+
+// jwtLeeway is the clock skew allowed when checking token lifetimes.
+const jwtLeeway = 30 * time.Second
+
+// minHMACKeySize is the smallest HMAC secret accepted, in bytes. RFC 7518
+// requires a secret at least as large as the hash, so HS384 and HS512 also
+// require larger secrets when tokens are verified.
+const minHMACKeySize = 32
+
+// minRSAKeySize is the smallest RSA modulus accepted, in bits, as required by
+// RFC 7518.
+const minRSAKeySize = 2048
+
+// checkHMACKey rejects secrets which are too short to be used for HS256.
+func checkHMACKey(secret []byte) error {
+	if len(secret) == 0 {
+		return fmt.Errorf("HMAC secret is empty")
+	}
+	if len(secret) < minHMACKeySize {
+		return fmt.Errorf("HMAC secret must be at least %d bytes, not %d", minHMACKeySize, len(secret))
+	}
+	return nil
+}
+
+// NewHMACJWTVerifier instances a JWTVerifier which accepts tokens signed
+// with HS256, HS384 or HS512 using the secret, which must be at least 32
+// bytes.
+func NewHMACJWTVerifier(secret []byte, claims JWTClaims) (*JWTVerifier, error) {
+	err := checkHMACKey(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JWTVerifier{
+		keys:   []verificationKey{{key: secret}},
+		claims: claims,
+		leeway: jwtLeeway,
+	}, nil
+}
+
+// NewJWKSJWTVerifier instances a JWTVerifier which accepts tokens signed
+// with any of the keys in the JWKS file at path. RSA, EC and oct (HMAC) keys
+// are supported, subject to the same minimum sizes as NewHMACJWTVerifier
+// and 2048 bits for RSA keys.
+func NewJWKSJWTVerifier(path string, claims JWTClaims) (*JWTVerifier, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	err = json.Unmarshal(raw, &set)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS '%s': %w", path, err)
+	}
+
+	v := &JWTVerifier{
+		claims: claims,
+		leeway: jwtLeeway,
+	}
+
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %d of JWKS '%s': %w", i, path, err)
+		}
+
+		v.keys = append(v.keys, verificationKey{kid: k.Kid, alg: k.Alg, key: key})
+	}
+
+	if len(v.keys) == 0 {
+		return nil, fmt.Errorf("JWKS '%s' contains no signing keys", path)
+	}
+
+	return v, nil
+}
+
+// decodeSegment decodes a base64url encoded value, with or without padding.
+func decodeSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// publicKey decodes the key.
+func (k *jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeSegment(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %w", err)
+		}
+
+		e, err := decodeSegment(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exponent: %w", err)
+		}
+
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("exponent is too large")
+		}
+
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+		if key.N.BitLen() < minRSAKeySize {
+			return nil, fmt.Errorf("RSA modulus must be at least %d bits, not %d", minRSAKeySize, key.N.BitLen())
+		}
+
+		return key, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+
+		x, err := decodeSegment(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x coordinate: %w", err)
+		}
+
+		y, err := decodeSegment(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y coordinate: %w", err)
+		}
+
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+
+		return key, nil
+
+	case "oct":
+		secret, err := decodeSegment(k.K)
+		if err != nil {
+			return nil, fmt.Errorf("invalid secret: %w", err)
+		}
+
+		err = checkHMACKey(secret)
+		if err != nil {
+			return nil, err
+		}
+
+		return secret, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type '%s'", k.Kty)
+}
+
+// algHashes maps the hash size in each algorithm name to the hash function.
+var algHashes = map[string]crypto.Hash{
+	"256": crypto.SHA256,
+	"384": crypto.SHA384,
+	"512": crypto.SHA512,
+}
+
+// algCurves maps the hash size in each ES algorithm name to the name of the
+// only curve which may be used with it.
+var algCurves = map[string]string{
+	"256": "P-256",
+	"384": "P-384",
+	"512": "P-521",
+}
+
+// verifySignature checks the signature of the signing input using the key,
+// according to the algorithm.
+func verifySignature(alg string, key interface{}, input, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported algorithm '%s'", alg)
+	}
+
+	hash, ok := algHashes[alg[2:]]
+	if !ok {
+		return fmt.Errorf("unsupported algorithm '%s'", alg)
+	}
+
+	h := hash.New()
+	h.Write(input)
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "HS":
+		secret, ok := key.([]byte)
+		if !ok {
+			return fmt.Errorf("key cannot be used with algorithm '%s'", alg)
+		}
+
+		if len(secret) < hash.Size() {
+			return fmt.Errorf("secret is too short for algorithm '%s'", alg)
+		}
+
+		mac := hmac.New(hash.New, secret)
+		mac.Write(input)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return fmt.Errorf("signature is invalid")
+		}
+		return nil
+
+	case "RS", "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key cannot be used with algorithm '%s'", alg)
+		}
+
+		if alg[:2] == "RS" {
+			return rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+		}
+		return rsa.VerifyPSS(pub, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve.Params().Name != algCurves[alg[2:]] {
+			return fmt.Errorf("key cannot be used with algorithm '%s'", alg)
+		}
+
+		// The signature is the concatenation of r and s, each padded
+		// to the size of the curve.
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return fmt.Errorf("signature is invalid")
+		}
+
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return fmt.Errorf("signature is invalid")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported algorithm '%s'", alg)
+}
+
+// invalidToken wraps the error with ErrInvalidToken.
+func invalidToken(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidToken, fmt.Sprintf(format, args...))
+}
+
+// Assert compliance with SubjectResolver
+var _ SubjectResolver = (*JWTVerifier)(nil)
+
+// ResolveSubject implements SubjectResolver.ResolveSubject, verifying the
+// request's "Authorization: Bearer" token, if it has one.
+func (v *JWTVerifier) ResolveSubject(r *http.Request) (*Identity, error) {
+	authorization := r.Header.Get("Authorization")
+	scheme, token, _ := strings.Cut(authorization, " ")
+	if authorization == "" || !strings.EqualFold(scheme, "Bearer") {
+		return nil, nil
+	}
+
+	return v.Verify(strings.TrimSpace(token))
+}
+
+// Challenge implements SubjectResolver.Challenge.
+func (v *JWTVerifier) Challenge() string {
+	return "Bearer"
+}
+
+// Verify checks the token's signature, lifetime, issuer and audience, and
+// returns the identity it establishes. Every error wraps ErrInvalidToken.
+func (v *JWTVerifier) Verify(token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, invalidToken("malformed token")
+	}
+
+	rawHeader, err := decodeSegment(parts[0])
+	if err != nil {
+		return nil, invalidToken("malformed header: %v", err)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err = json.Unmarshal(rawHeader, &header)
+	if err != nil {
+		return nil, invalidToken("malformed header: %v", err)
+	}
+
+	sig, err := decodeSegment(parts[2])
+	if err != nil {
+		return nil, invalidToken("malformed signature: %v", err)
+	}
+
+	// Try every key which may have signed the token. Note that "none"
+	// is never accepted, since verifySignature does not support it.
+	input := []byte(parts[0] + "." + parts[1])
+	err = fmt.Errorf("no key matches kid '%s' and alg '%s'", header.Kid, header.Alg)
+	verified := false
+	for _, k := range v.keys {
+		if header.Kid != "" && k.kid != "" && k.kid != header.Kid {
+			continue
+		}
+
+		if k.alg != "" && k.alg != header.Alg {
+			continue
+		}
+
+		err = verifySignature(header.Alg, k.key, input, sig)
+		if err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, invalidToken("%v", err)
+	}
+
+	rawClaims, err := decodeSegment(parts[1])
+	if err != nil {
+		return nil, invalidToken("malformed claims: %v", err)
+	}
+
+	claims := map[string]interface{}{}
+	decoder := json.NewDecoder(strings.NewReader(string(rawClaims)))
+	decoder.UseNumber()
+	err = decoder.Decode(&claims)
+	if err != nil {
+		return nil, invalidToken("malformed claims: %v", err)
+	}
+
+	err = v.checkClaims(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return v.identity(token, claims)
+}
+
+// numericDate returns the time of a NumericDate claim, and false if the claim
+// is absent.
+func numericDate(claims map[string]interface{}, name string) (time.Time, bool, error) {
+	value, ok := claims[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+
+	n, ok := value.(json.Number)
+	if !ok {
+		return time.Time{}, false, invalidToken("claim '%s' is not a number", name)
+	}
+
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false, invalidToken("claim '%s' is not a number", name)
+	}
+
+	return time.Unix(int64(f), 0), true, nil
+}
+
+// checkClaims checks the registered claims of the token.
+func (v *JWTVerifier) checkClaims(claims map[string]interface{}) error {
+	now := time.Now()
+
+	exp, ok, err := numericDate(claims, "exp")
+	if err != nil {
+		return err
+	} else if !ok && !v.claims.AllowNoExpiry {
+		return invalidToken("token has no expiry")
+	} else if ok && now.After(exp.Add(v.leeway)) {
+		return invalidToken("token expired at %s", exp.UTC().Format(time.RFC3339))
+	}
+
+	nbf, ok, err := numericDate(claims, "nbf")
+	if err != nil {
+		return err
+	} else if ok && now.Add(v.leeway).Before(nbf) {
+		return invalidToken("token is not valid until %s", nbf.UTC().Format(time.RFC3339))
+	}
+
+	if v.claims.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.claims.Issuer {
+			return invalidToken("unexpected issuer '%s'", iss)
+		}
+	}
+
+	if v.claims.Audience != "" {
+		audiences := claimStrings(claims["aud"])
+		found := false
+		for _, aud := range audiences {
+			if aud == v.claims.Audience {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return invalidToken("token is not intended for audience '%s'", v.claims.Audience)
+		}
+	}
+
+	return nil
+}
+
+// claimValue looks up a claim, either by its exact name, or as a path into
+// nested claims.
+func claimValue(claims map[string]interface{}, name string) (interface{}, bool) {
+	if value, ok := claims[name]; ok {
+		return value, true
+	}
+
+	path, err := ParseResultPath(name)
+	if err != nil {
+		return nil, false
+	}
+
+	return path.Lookup(claims)
+}
+
+// claimStrings converts a claim which is a string or a list of strings to a
+// list of strings. Other values are ignored.
+func claimStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		strs := []string{}
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				strs = append(strs, s)
+			}
+		}
+		return strs
+	}
+	return nil
+}
+
+// identity extracts the identity from the token's claims.
+func (v *JWTVerifier) identity(token string, claims map[string]interface{}) (*Identity, error) {
+	id := &Identity{
+		JWT:        token,
+		Attributes: map[string]string{},
+	}
+
+	subject, _ := claimValue(claims, v.claims.Subject)
+	id.Subject, _ = subject.(string)
+	if id.Subject == "" {
+		return nil, invalidToken("token has no '%s' claim", v.claims.Subject)
+	}
+
+	if v.claims.Roles != "" {
+		roles, _ := claimValue(claims, v.claims.Roles)
+		id.Roles = claimStrings(roles)
+	}
+
+	if v.claims.Groups != "" {
+		groups, _ := claimValue(claims, v.claims.Groups)
+		id.Groups = claimStrings(groups)
+	}
+
+	for _, name := range v.claims.Attributes {
+		value, ok := claimValue(claims, name)
+		if !ok {
+			continue
+		}
+
+		if s, ok := value.(string); ok {
+			id.Attributes[name] = s
+			continue
+		}
+
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, invalidToken("claim '%s' cannot be encoded: %v", name, err)
+		}
+		id.Attributes[name] = string(raw)
+	}
+
+	return id, nil
+}
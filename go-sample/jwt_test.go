@@ -0,0 +1,363 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+
+// encodeSegment base64url encodes a JSON value for use in a token.
+func encodeSegment(t *testing.T, value interface{}) string {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// signToken builds a token with the header and claims, signed by key
+// according to alg. key is a []byte secret, an *rsa.PrivateKey or an
+// *ecdsa.PrivateKey, or nil for an empty signature.
+func signToken(t *testing.T, header map[string]interface{}, claims map[string]interface{}, key interface{}) string {
+	alg, _ := header["alg"].(string)
+	input := encodeSegment(t, header) + "." + encodeSegment(t, claims)
+
+	var sig []byte
+	if key != nil {
+		hash := algHashes[alg[2:]]
+		h := hash.New()
+		h.Write([]byte(input))
+		digest := h.Sum(nil)
+
+		var err error
+		switch k := key.(type) {
+		case []byte:
+			mac := hmac.New(hash.New, k)
+			mac.Write([]byte(input))
+			sig = mac.Sum(nil)
+		case *rsa.PrivateKey:
+			sig, err = rsa.SignPKCS1v15(rand.Reader, k, hash, digest)
+		case *ecdsa.PrivateKey:
+			var r, s *big.Int
+			r, s, err = ecdsa.Sign(rand.Reader, k, digest)
+			size := (k.Curve.Params().BitSize + 7) / 8
+			sig = make([]byte, 2*size)
+			r.FillBytes(sig[:size])
+			s.FillBytes(sig[size:])
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// validClaims returns claims which pass every check of a verifier
+// configured with testClaims.
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub":   "alice",
+		"roles": []string{"admin"},
+		"iss":   "https://issuer.example.com",
+		"aud":   []string{"other", "carinfo"},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+var testClaims = JWTClaims{
+	Subject:  "sub",
+	Roles:    "roles",
+	Issuer:   "https://issuer.example.com",
+	Audience: "carinfo",
+}
+
+// writeJWKS writes a JWKS containing the keys to a temporary file.
+func writeJWKS(t *testing.T, keys ...map[string]string) string {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	raw, err := json.Marshal(map[string]interface{}{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, raw, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func rsaJWK(pub *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"n":   b64(pub.N.Bytes()),
+		"e":   b64(big.NewInt(int64(pub.E)).Bytes()),
+	}
+}
+
+func ecJWK(pub *ecdsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "EC",
+		"crv": pub.Curve.Params().Name,
+		"x":   b64(pub.X.Bytes()),
+		"y":   b64(pub.Y.Bytes()),
+	}
+}
+
+// expectInvalid checks that the token is rejected with ErrInvalidToken.
+func expectInvalid(t *testing.T, v *JWTVerifier, token string, reason string) {
+	t.Helper()
+	id, err := v.Verify(token)
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("%s: expected ErrInvalidToken, got identity %+v, error %v", reason, id, err)
+	}
+}
+
+func TestJWTVerifierAcceptsValidToken(t *testing.T) {
+	v, err := NewHMACJWTVerifier(testSecret, testClaims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, alg := range []string{"HS256", "HS384", "HS512"} {
+		token := signToken(t, map[string]interface{}{"alg": alg}, validClaims(), testSecret)
+		id, err := v.Verify(token)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", alg, err)
+		}
+		if id.Subject != "alice" || len(id.Roles) != 1 || id.Roles[0] != "admin" || id.JWT != token {
+			t.Errorf("%s: unexpected identity %+v", alg, id)
+		}
+	}
+}
+
+func TestJWTVerifierRejectsUnsignedTokens(t *testing.T) {
+	v, err := NewHMACJWTVerifier(testSecret, testClaims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, alg := range []string{"none", "None", "NONE", ""} {
+		token := signToken(t, map[string]interface{}{"alg": alg}, validClaims(), nil)
+		expectInvalid(t, v, token, "alg '"+alg+"'")
+	}
+
+	// An HMAC token with its signature stripped.
+	token := signToken(t, map[string]interface{}{"alg": "HS256"}, validClaims(), testSecret)
+	expectInvalid(t, v, token[:strings.LastIndex(token, ".")+1], "stripped signature")
+}
+
+func TestJWTVerifierRejectsForgedTokens(t *testing.T) {
+	v, err := NewHMACJWTVerifier(testSecret, testClaims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := []byte(strings.Repeat("x", 64))
+	expectInvalid(t, v, signToken(t, map[string]interface{}{"alg": "HS256"}, validClaims(), other), "wrong secret")
+
+	// Swap the claims of a valid token for another subject's.
+	token := signToken(t, map[string]interface{}{"alg": "HS256"}, validClaims(), testSecret)
+	parts := strings.Split(token, ".")
+	claims := validClaims()
+	claims["sub"] = "mallory"
+	parts[1] = encodeSegment(t, claims)
+	expectInvalid(t, v, strings.Join(parts, "."), "tampered claims")
+
+	expectInvalid(t, v, "not-a-token", "malformed token")
+}
+
+func TestJWTVerifierRejectsAlgorithmConfusion(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := NewJWKSJWTVerifier(writeJWKS(t, rsaJWK(&key.PublicKey)), testClaims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := signToken(t, map[string]interface{}{"alg": "RS256"}, validClaims(), key)
+	if _, err := v.Verify(valid); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Use the public key, which an attacker knows, as an HMAC secret.
+	for _, secret := range [][]byte{key.PublicKey.N.Bytes(), []byte(b64(key.PublicKey.N.Bytes()))} {
+		token := signToken(t, map[string]interface{}{"alg": "HS256"}, validClaims(), secret)
+		expectInvalid(t, v, token, "HS256 with the RSA public key")
+	}
+
+	// An RSA signed token must not be accepted by an HMAC verifier.
+	h, err := NewHMACJWTVerifier(testSecret, testClaims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectInvalid(t, h, valid, "RS256 token with an HMAC verifier")
+}
+
+func TestJWTVerifierChecksECCurves(t *testing.T) {
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := NewJWKSJWTVerifier(writeJWKS(t, ecJWK(&p256.PublicKey), ecJWK(&p384.PublicKey)), testClaims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		alg   string
+		key   *ecdsa.PrivateKey
+		valid bool
+	}{
+		{"ES256", p256, true},
+		{"ES384", p384, true},
+		{"ES256", p384, false},
+		{"ES384", p256, false},
+		{"ES512", p384, false},
+	} {
+		token := signToken(t, map[string]interface{}{"alg": test.alg}, validClaims(), test.key)
+		_, err := v.Verify(token)
+		if test.valid && err != nil {
+			t.Errorf("%s with %s: unexpected error: %v", test.alg, test.key.Curve.Params().Name, err)
+		} else if !test.valid && !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s with %s: expected ErrInvalidToken, got %v", test.alg, test.key.Curve.Params().Name, err)
+		}
+	}
+}
+
+func TestJWTVerifierChecksLifetime(t *testing.T) {
+	v, err := NewHMACJWTVerifier(testSecret, testClaims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := map[string]interface{}{"alg": "HS256"}
+
+	claims := validClaims()
+	claims["exp"] = time.Now().Add(-time.Minute).Unix()
+	expectInvalid(t, v, signToken(t, header, claims, testSecret), "expired")
+
+	claims = validClaims()
+	claims["nbf"] = time.Now().Add(time.Minute).Unix()
+	expectInvalid(t, v, signToken(t, header, claims, testSecret), "not yet valid")
+
+	claims = validClaims()
+	claims["exp"] = "tomorrow"
+	expectInvalid(t, v, signToken(t, header, claims, testSecret), "non-numeric exp")
+
+	// Tokens without an expiry are only accepted if configured.
+	claims = validClaims()
+	delete(claims, "exp")
+	expectInvalid(t, v, signToken(t, header, claims, testSecret), "no exp")
+
+	lenient := testClaims
+	lenient.AllowNoExpiry = true
+	l, err := NewHMACJWTVerifier(testSecret, lenient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Verify(signToken(t, header, claims, testSecret)); err != nil {
+		t.Errorf("no exp with AllowNoExpiry: unexpected error: %v", err)
+	}
+
+	// Expiry within the leeway is allowed for clock skew.
+	claims = validClaims()
+	claims["exp"] = time.Now().Add(-jwtLeeway / 2).Unix()
+	if _, err := v.Verify(signToken(t, header, claims, testSecret)); err != nil {
+		t.Errorf("expiry within leeway: unexpected error: %v", err)
+	}
+}
+
+func TestJWTVerifierChecksIssuerAndAudience(t *testing.T) {
+	v, err := NewHMACJWTVerifier(testSecret, testClaims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := map[string]interface{}{"alg": "HS256"}
+
+	for name, change := range map[string]func(map[string]interface{}){
+		"wrong issuer":     func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" },
+		"missing issuer":   func(c map[string]interface{}) { delete(c, "iss") },
+		"wrong audience":   func(c map[string]interface{}) { c["aud"] = "other" },
+		"audience list":    func(c map[string]interface{}) { c["aud"] = []string{"other", "carinfo-admin"} },
+		"missing audience": func(c map[string]interface{}) { delete(c, "aud") },
+		"missing subject":  func(c map[string]interface{}) { delete(c, "sub") },
+	} {
+		claims := validClaims()
+		change(claims)
+		expectInvalid(t, v, signToken(t, header, claims, testSecret), name)
+	}
+
+	claims := validClaims()
+	claims["aud"] = "carinfo"
+	if _, err := v.Verify(signToken(t, header, claims, testSecret)); err != nil {
+		t.Errorf("single audience: unexpected error: %v", err)
+	}
+}
+
+func TestJWTVerifierRejectsWeakKeys(t *testing.T) {
+	for _, secret := range [][]byte{nil, {}, []byte("secret"), testSecret[:minHMACKeySize-1]} {
+		if _, err := NewHMACJWTVerifier(secret, testClaims); err == nil {
+			t.Errorf("expected secret of %d bytes to be rejected", len(secret))
+		}
+	}
+
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, key := range map[string]map[string]string{
+		"empty oct":    {"kty": "oct", "k": ""},
+		"short oct":    {"kty": "oct", "k": b64([]byte("secret"))},
+		"1024 bit RSA": rsaJWK(&small.PublicKey),
+	} {
+		if _, err := NewJWKSJWTVerifier(writeJWKS(t, key), testClaims); err == nil {
+			t.Errorf("expected JWKS with %s key to be rejected", name)
+		}
+	}
+
+	// A 32 byte secret may be used for HS256, but is too short for HS512.
+	secret := testSecret[:minHMACKeySize]
+	v, err := NewHMACJWTVerifier(secret, testClaims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := map[string]interface{}{"alg": "HS256"}
+	if _, err := v.Verify(signToken(t, header, validClaims(), secret)); err != nil {
+		t.Errorf("HS256: unexpected error: %v", err)
+	}
+
+	header["alg"] = "HS512"
+	expectInvalid(t, v, signToken(t, header, validClaims(), secret), "HS512 with a 32 byte secret")
+}
@@ -0,0 +1,167 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/open-policy-agent/opa/plugins/bundle"
+	"github.com/open-policy-agent/opa/sdk"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+//
+// This file defines the Prometheus metrics exported by the sample. The
+// collectors are package-level, and registered with a registry of their own
+// rather than the default one, so that importing the package does not affect
+// any other metrics the importer exports. GetMetricsHandler serves them.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// metricsRegistry holds every collector defined in this file, along with the
+// standard Go runtime and process collectors.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	decisionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "entitlements_decision_duration_seconds",
+		Help:    "Time taken by each decider to make a decision, including failed attempts.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"decider", "result"})
+
+	entitlementsDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "entitlements_decisions_total",
+		Help: "Requests checked by the EntitlementsHandler, by action, route template and result (allow, deny, monitored_deny or error).",
+	}, []string{"action", "route", "result"})
+
+	cacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "entitlements_decision_cache_lookups_total",
+		Help: "Decision cache lookups, by result (hit or miss).",
+	}, []string{"result"})
+
+	bundleDownloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "entitlements_bundle_downloads_total",
+		Help: "Successful policy bundle downloads by the embedded OPA, by bundle name.",
+	}, []string{"bundle"})
+
+	bundleActivations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "entitlements_bundle_activations_total",
+		Help: "Successful policy bundle activations by the embedded OPA, by bundle name.",
+	}, []string{"bundle"})
+
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "carinfostore_http_requests_total",
+		Help: "Requests served by the API handlers, by method, route template and status code.",
+	}, []string{"method", "route", "code"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "carinfostore_http_request_duration_seconds",
+		Help:    "Time taken by the API handlers to serve each request, by method and route template.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	storeSaveDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "carinfostore_store_save_duration_seconds",
+		Help:    "Time taken to write a snapshot of the JSON file store to disk.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	storeSaveFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "carinfostore_store_save_failures_total",
+		Help: "Failed attempts to write a snapshot of the JSON file store to disk.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		decisionDuration,
+		entitlementsDecisions,
+		cacheLookups,
+		bundleDownloads,
+		bundleActivations,
+		httpRequests,
+		httpDuration,
+		storeSaveDuration,
+		storeSaveFailures,
+	)
+}
+
+// GetMetricsHandler returns an http.Handler which serves the metrics in the
+// Prometheus exposition format.
+func GetMetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// observeDecision records how long a decider took to make a decision, or to
+// fail to.
+func observeDecision(decider string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	decisionDuration.WithLabelValues(decider, result).Observe(time.Since(start).Seconds())
+}
+
+// RecordBundleMetrics counts the policy bundles which the embedded OPA
+// downloads and activates. It uses the same bundle status listener
+// mechanism as the playground, so the counts match the playground's.
+func RecordBundleMetrics(opa *sdk.OPA) {
+	plugin, ok := opa.Plugin("bundle").(*bundle.Plugin)
+	if !ok {
+		return
+	}
+
+	// NOTE: these variables carry state across calls to the below
+	// callback, which OPA may make from several goroutines.
+	var mutex sync.Mutex
+	lastDownload := map[string]time.Time{}
+	lastActivation := map[string]time.Time{}
+
+	plugin.Register("metrics", func(status bundle.Status) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if status.LastSuccessfulDownload.After(lastDownload[status.Name]) {
+			lastDownload[status.Name] = status.LastSuccessfulDownload
+			bundleDownloads.WithLabelValues(status.Name).Inc()
+		}
+
+		if status.LastSuccessfulActivation.After(lastActivation[status.Name]) {
+			lastActivation[status.Name] = status.LastSuccessfulActivation
+			bundleActivations.WithLabelValues(status.Name).Inc()
+		}
+	})
+}
+
+// instrumentAPI is mux middleware which records metrics for each request
+// served by the API handlers, labeled with the template of the route which
+// matched it.
+func instrumentAPI(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		httpRequests.WithLabelValues(r.Method, route, strconv.Itoa(recorder.Status())).Inc()
+		httpDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
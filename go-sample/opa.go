@@ -8,11 +8,20 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/open-policy-agent/opa/sdk"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
 )
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -35,6 +44,21 @@ import (
 type OPADecision struct {
 	ID     string      `json:"ID"`
 	Result interface{} `json:"result"`
+
+	// Source identifies the decider which made the decision, if it was
+	// obtained via a FallbackDecider.
+	Source string `json:"source,omitempty"`
+
+	// Fallback is true if the decision was not made by evaluating the
+	// policy, but stands in for one while OPA is unavailable, such as the
+	// fallback decision of an open circuit breaker. It is never cached.
+	Fallback bool `json:"fallback,omitempty"`
+
+	// Cached is true if the decision was returned by a CachingDecider
+	// rather than evaluated for this input. A cached decision keeps the ID
+	// of the evaluation which produced it, so several requests may share
+	// the same ID.
+	Cached bool `json:"cached,omitempty"`
 }
 
 // HTTPDecision represents a decision obtained via HTTP. The SDK has it's own
@@ -45,7 +69,7 @@ type HTTPDecision struct {
 	Path         string            `json:"path"`
 	Input        interface{}       `json:"input"`
 	Result       interface{}       `json:"result"`
-	Timestamp    string            `json:"timestamp`
+	Timestamp    string            `json:"timestamp"`
 	Metrics      map[string]int    `json:"metrics"`
 	AgentID      string            `json:"agent_id"`
 	SystemID     string            `json:"system_id"`
@@ -61,18 +85,77 @@ type HTTPDecision struct {
 type OPADecider interface {
 
 	// Decision should take an input, which must be JSON-serializeable,
-	// and will be used as the input document for OPA.
+	// and will be used as the input document for OPA. It should give up
+	// once the context is done.
 	//
 	// It returns the result object and an error, if any.
-	Decision(input interface{}) (*OPADecision, error)
+	Decision(ctx context.Context, input interface{}) (*OPADecision, error)
+}
+
+// BatchOPADecider is implemented by OPADeciders which are able to obtain
+// several decisions in a single query, e.g. via a batch query API.
+type BatchOPADecider interface {
+	OPADecider
+
+	// Decisions should return one decision per input, in the same order
+	// as the inputs.
+	Decisions(ctx context.Context, inputs []interface{}) ([]*OPADecision, error)
+}
+
+// maxConcurrentDecisions bounds the number of decisions Decisions() will
+// request at once from deciders which do not support batching.
+const maxConcurrentDecisions = 8
+
+// Decisions obtains a decision for each of the inputs. If the decider is a
+// BatchOPADecider, they are obtained in a single batch, otherwise they are
+// obtained individually, several at a time.
+func Decisions(ctx context.Context, d OPADecider, inputs []interface{}) ([]*OPADecision, error) {
+	if batch, ok := d.(BatchOPADecider); ok {
+		decisions, err := batch.Decisions(ctx, inputs)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(decisions) != len(inputs) {
+			return nil, fmt.Errorf("asked for %d decisions, but got %d", len(inputs), len(decisions))
+		}
+
+		return decisions, nil
+	}
+
+	decisions := make([]*OPADecision, len(inputs))
+	errs := make([]error, len(inputs))
+
+	sem := make(chan struct{}, maxConcurrentDecisions)
+	wg := sync.WaitGroup{}
+	for i, input := range inputs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, input interface{}) {
+			defer wg.Done()
+			decisions[i], errs[i] = d.Decision(ctx, input)
+			<-sem
+		}(i, input)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return decisions, nil
 }
 
 // Assert compliance with OPADecider
 var _ OPADecider = (*SDKDecider)(nil)
 
+// SDKDecider obtains decisions from an OPA embedded via the SDK. It does not
+// implement BatchOPADecider, since the SDK evaluates one input at a time, so
+// Decisions() asks it for each decision individually.
 type SDKDecider struct {
 	opa  *sdk.OPA
-	ctx  context.Context
 	path string
 }
 
@@ -82,16 +165,23 @@ type SDKDecider struct {
 //
 // path should be the rule path that is to be used when constructing
 // sdk.DecisionOptions.
-func NewSDKDecider(opa *sdk.OPA, ctx context.Context, path string) OPADecider {
+func NewSDKDecider(opa *sdk.OPA, path string) OPADecider {
 	return &SDKDecider{
 		opa:  opa,
-		ctx:  ctx,
 		path: path,
 	}
 }
 
 // Decision implements OPADecider.Decision.
-func (d *SDKDecider) Decision(input interface{}) (*OPADecision, error) {
+func (d *SDKDecider) Decision(ctx context.Context, input interface{}) (*OPADecision, error) {
+	ctx, span := startDecisionSpan(ctx, "sdk")
+	decision, err := d.decision(ctx, input)
+	endDecisionSpan(span, decision, err)
+	return decision, err
+}
+
+// decision implements Decision, without tracing.
+func (d *SDKDecider) decision(ctx context.Context, input interface{}) (*OPADecision, error) {
 	log.Printf("Asking OPA for a decision on input document %v\n", input)
 
 	decOpts := sdk.DecisionOptions{
@@ -99,7 +189,7 @@ func (d *SDKDecider) Decision(input interface{}) (*OPADecision, error) {
 		Input: input,
 	}
 
-	result, err := d.opa.Decision(d.ctx, decOpts)
+	result, err := d.opa.Decision(ctx, decOpts)
 	if err != nil {
 		log.Printf("OPA error (denying request): %v\n", err)
 		return nil, err
@@ -108,25 +198,141 @@ func (d *SDKDecider) Decision(input interface{}) (*OPADecision, error) {
 	return &OPADecision{ID: result.ID, Result: result.Result}, nil
 }
 
-// Assert compliance with OPADecider
+// Assert compliance with OPADecider, HealthReporter and ReadinessChecker
 var _ OPADecider = (*HTTPDecider)(nil)
+var _ HealthReporter = (*HTTPDecider)(nil)
+var _ ReadinessChecker = (*HTTPDecider)(nil)
 
+// HTTPDecider obtains decisions from an OPA server via its REST API. It does
+// not implement BatchOPADecider, since the open source OPA server has no
+// batch query API, so Decisions() asks it for each decision individually.
 type HTTPDecider struct {
 	url string
+
+	retries int
+	backoff time.Duration
+
+	breaker  *circuitBreaker
+	fallback *OPADecision
+}
+
+// HTTPDeciderOption configures optional behavior of an HTTPDecider.
+type HTTPDeciderOption func(d *HTTPDecider)
+
+// WithRetries makes the HTTPDecider retry failed requests up to retries
+// times. The delay before each retry starts at backoff and doubles each time,
+// with random jitter so that many requests failing at once do not all retry
+// at once. Only transport errors, and responses indicating that OPA is
+// overloaded or broken (429 and 5xx), are retried.
+func WithRetries(retries int, backoff time.Duration) HTTPDeciderOption {
+	return func(d *HTTPDecider) {
+		d.retries = retries
+		d.backoff = backoff
+	}
+}
+
+// WithCircuitBreaker makes the HTTPDecider stop asking OPA for decisions
+// once threshold consecutive decisions have failed, and fail fast instead,
+// until cooldown has passed. While the breaker is open, the fallback decision
+// is returned if it is not nil ("fail open"), otherwise ErrCircuitOpen is
+// returned ("fail closed"). The fallback decision is returned with Fallback
+// set.
+func WithCircuitBreaker(threshold int, cooldown time.Duration, fallback *OPADecision) HTTPDeciderOption {
+	return func(d *HTTPDecider) {
+		d.breaker = newCircuitBreaker(threshold, cooldown)
+		d.fallback = nil
+		if fallback != nil {
+			copied := *fallback
+			copied.Fallback = true
+			d.fallback = &copied
+		}
+	}
+}
+
+// maxRetryBackoff bounds the delay between retries.
+const maxRetryBackoff = 5 * time.Second
+
+// maxStatusErrorBody bounds how much of the body of an unexpected response
+// from OPA is included in the OPAStatusError.
+const maxStatusErrorBody = 256
+
+// OPAStatusError is returned by HTTPDecider if OPA responds with a status
+// other than 200.
+type OPAStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *OPAStatusError) Error() string {
+	return fmt.Sprintf("OPA responded with status %d: %s", e.StatusCode, e.Body)
+}
+
+// retryable returns true if the request should be tried again.
+func (e *OPAStatusError) retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
 }
 
 // NewHTTPDecider instances an OPADecider that uses the OPA running as a
 // sidecar, accessed using HTTP REST calls.
 //
 // The url should be the URL at which OPA should be queried.
-func NewHTTPDecider(url string) OPADecider {
-	return &HTTPDecider{
-		url: url,
+func NewHTTPDecider(url string, opts ...HTTPDeciderOption) OPADecider {
+	d := &HTTPDecider{
+		url:     url,
+		breaker: newCircuitBreaker(0, 0),
 	}
+
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	return d
+}
+
+// Health implements HealthReporter.Health.
+func (d *HTTPDecider) Health() DeciderHealth {
+	return d.breaker.health()
+}
+
+// Ready implements ReadinessChecker.Ready, by probing the health endpoint of
+// the OPA server, which only reports that OPA is healthy once it has
+// activated its bundles.
+func (d *HTTPDecider) Ready(ctx context.Context) error {
+	u, err := url.Parse(d.url)
+	if err != nil {
+		return err
+	}
+	u.Path = "/health"
+	u.RawQuery = "bundles"
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("OPA health check responded with status %d", resp.StatusCode)
+	}
+
+	return nil
 }
 
 // Decision implements OPADecider.Decision.
-func (d *HTTPDecider) Decision(input interface{}) (*OPADecision, error) {
+func (d *HTTPDecider) Decision(ctx context.Context, input interface{}) (*OPADecision, error) {
+	ctx, span := startDecisionSpan(ctx, "http")
+	decision, err := d.decision(ctx, input)
+	endDecisionSpan(span, decision, err)
+	return decision, err
+}
+
+// decision implements Decision, without tracing.
+func (d *HTTPDecider) decision(ctx context.Context, input interface{}) (*OPADecision, error) {
 	log.Printf("Asking OPA for a decision on input document %v\n", input)
 
 	// Prepare the data to be sent to the OPA server
@@ -139,8 +345,75 @@ func (d *HTTPDecider) Decision(input interface{}) (*OPADecision, error) {
 		return nil, err
 	}
 
-	// Perform the PUT
-	resp, err := http.Post(d.url, "application/json; charset=utf-8", bytes.NewBuffer(reqData))
+	if !d.breaker.allow() {
+		if d.fallback != nil {
+			log.Printf("OPA circuit breaker is open, failing open with decision %s\n", d.fallback.ID)
+			return d.fallback, nil
+		}
+		return nil, ErrCircuitOpen
+	}
+
+	for attempt := 0; ; attempt++ {
+		var decision *OPADecision
+		decision, err = d.post(ctx, reqData)
+
+		var statusErr *OPAStatusError
+		retryable := err != nil && (!errors.As(err, &statusErr) || statusErr.retryable())
+
+		if !retryable {
+			// Either OPA answered, or the request was bad, which
+			// means OPA is up.
+			d.breaker.success()
+			return decision, err
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		if attempt >= d.retries {
+			break
+		}
+
+		delay := d.backoff << attempt
+		if delay <= 0 || delay > maxRetryBackoff {
+			delay = maxRetryBackoff
+		}
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+
+		log.Printf("OPA request failed, retrying in %v: %v\n", delay, err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+
+	if errors.Is(ctx.Err(), context.Canceled) {
+		// The client went away, which says nothing about OPA.
+		d.breaker.abandon()
+	} else {
+		d.breaker.failure(err)
+	}
+
+	return nil, err
+}
+
+// post sends a single request to OPA.
+func (d *HTTPDecider) post(ctx context.Context, reqData []byte) (*OPADecision, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", d.url, bytes.NewBuffer(reqData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	// Propagate the trace context to OPA, so that its spans join the
+	// trace of the request being decided.
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -152,6 +425,14 @@ func (d *HTTPDecider) Decision(input interface{}) (*OPADecision, error) {
 		return nil, err
 	}
 
+	if resp.StatusCode != http.StatusOK {
+		body := strings.TrimSpace(string(bodyBytes))
+		if len(body) > maxStatusErrorBody {
+			body = body[:maxStatusErrorBody] + "..."
+		}
+		return nil, &OPAStatusError{StatusCode: resp.StatusCode, Body: body}
+	}
+
 	decision := &HTTPDecision{}
 	err = json.Unmarshal(bodyBytes, decision)
 	if err != nil {
@@ -161,8 +442,9 @@ func (d *HTTPDecider) Decision(input interface{}) (*OPADecision, error) {
 	return &OPADecision{ID: decision.DecisionID, Result: decision.Result}, nil
 }
 
-// Assert compliance with OPADecider
+// Assert compliance with OPADecider and BatchOPADecider
 var _ OPADecider = (*DummyDecider)(nil)
+var _ BatchOPADecider = (*DummyDecider)(nil)
 
 type DummyDecider struct {
 	decision *OPADecision
@@ -177,6 +459,15 @@ func NewDummyDecider(decision *OPADecision) OPADecider {
 }
 
 // Decision implement OPADecider.Decision.
-func (d *DummyDecider) Decision(input interface{}) (*OPADecision, error) {
+func (d *DummyDecider) Decision(ctx context.Context, input interface{}) (*OPADecision, error) {
 	return d.decision, nil
 }
+
+// Decisions implements BatchOPADecider.Decisions.
+func (d *DummyDecider) Decisions(ctx context.Context, inputs []interface{}) ([]*OPADecision, error) {
+	decisions := make([]*OPADecision, len(inputs))
+	for i := range decisions {
+		decisions[i] = d.decision
+	}
+	return decisions, nil
+}
@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -16,6 +17,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Car represents information about a car on the lot.
@@ -50,211 +52,797 @@ type Status struct {
 type PersistanceData struct {
 	Cars     map[string]Car    `json:"cars"`
 	Statuses map[string]Status `json:"statuses"`
+
+	// Revision is the most recently assigned revision number.
+	Revision uint64 `json:"revision"`
+
+	// CarRevisions and StatusRevisions hold the current revision of each
+	// car and status respectively, keyed by car ID.
+	CarRevisions    map[string]uint64 `json:"car_revisions"`
+	StatusRevisions map[string]uint64 `json:"status_revisions"`
+
+	// History holds the change history of each car, keyed by car ID.
+	History map[string][]HistoryEntry `json:"history"`
+
+	// JournalSequence is the sequence number of the last journal entry
+	// captured in the snapshot.
+	JournalSequence uint64 `json:"journal_sequence"`
+
+	// NextCarNumber is the number of the ID which will next be allocated
+	// to a new car. It only ever increases, so that the ID of a deleted
+	// car, whose history is kept, is never given to another.
+	NextCarNumber uint64 `json:"next_car_number"`
+}
+
+// validateIDs returns an error if any of the data is keyed by an invalid car
+// ID.
+func (pd *PersistanceData) validateIDs() error {
+	for _, ids := range [][]string{
+		sortedKeys(pd.Cars),
+		sortedKeys(pd.Statuses),
+		sortedKeys(pd.CarRevisions),
+		sortedKeys(pd.StatusRevisions),
+		sortedKeys(pd.History),
+	} {
+		for _, id := range ids {
+			if !ValidateID(id) {
+				return fmt.Errorf("invalid car ID '%s'", id)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Author identifies who made a change to the store, and the Entitlements
+// decision that allowed them to make it.
+type Author struct {
+	Subject    string `json:"subject"`
+	DecisionID string `json:"decision_id"`
+}
+
+// Resources which can appear in a HistoryEntry.
+const (
+	HistoryCar    = "car"
+	HistoryStatus = "status"
+)
+
+// HistoryEntry records a single change made to a car or it's status.
+type HistoryEntry struct {
+	Author
+
+	// Timestamp is the time at which the change was made.
+	Timestamp time.Time `json:"timestamp"`
+
+	// Resource is the record that was changed, either HistoryCar or
+	// HistoryStatus.
+	Resource string `json:"resource"`
+
+	// Revision is the revision of the record after the change, or 0 if
+	// the change deleted it.
+	Revision uint64 `json:"revision"`
+
+	// Previous and New are the JSON encoded record before and after the
+	// change. Previous is null if the record was created, and New is null
+	// if it was deleted.
+	Previous json.RawMessage `json:"previous"`
+	New      json.RawMessage `json:"new"`
+}
+
+// newHistoryEntry creates a HistoryEntry timestamped with the current time.
+// A nil previous or next value is recorded as null.
+func newHistoryEntry(author Author, resource string, revision uint64, previous, next interface{}) (HistoryEntry, error) {
+	e := HistoryEntry{
+		Author:    author,
+		Timestamp: time.Now().UTC(),
+		Resource:  resource,
+		Revision:  revision,
+	}
+
+	var err error
+	e.Previous, err = json.Marshal(previous)
+	if err != nil {
+		return e, err
+	}
+
+	e.New, err = json.Marshal(next)
+	return e, err
 }
 
-var persistanceCars map[string]Car = map[string]Car{}
-var persistanceStatuses map[string]Status = map[string]Status{}
+// ErrCarNotFound is returned by CarStore.SetStatus when the car does not
+// exist.
+var ErrCarNotFound = errors.New("car does not exist")
+
+// ErrPreconditionFailed is returned by CarStore methods when the
+// Precondition passed to them is not satisfied.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// Precondition is checked by a CarStore against the current revision of the
+// record that is about to be modified, atomically with the modification. The
+// revision is 0 if the record does not exist. If the Precondition returns
+// false, the record is left alone and ErrPreconditionFailed is returned.
+//
+// A nil Precondition is always satisfied.
+type Precondition func(revision uint64) bool
+
+// check returns ErrPreconditionFailed if the Precondition is not satisfied
+// by the given revision.
+func (p Precondition) check(revision uint64) error {
+	if p != nil && !p(revision) {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+// CarStore represents something capable of storing cars and their statuses.
+//
+// Each of the mutating methods takes the Author of the change, which is
+// recorded in the car's history along with the values before and after the
+// change. The history of a car is kept after it is deleted, and its ID is
+// never given to another car.
+//
+// Every car and every status carries a revision number, which changes each
+// time the record is written. Revisions are assigned from a counter which is
+// shared by all records in the store, so a revision is never reused, even if
+// a record is deleted and then created again. A revision of 0 means that the
+// record does not exist.
+//
+// All methods must be safe for concurrent use, since the API handlers call
+// them from many goroutines at once.
+type CarStore interface {
+
+	// GetCarIDs returns a list of all extant car IDs.
+	GetCarIDs() ([]string, error)
+
+	// GetCar returns the car with the specified ID, and it's revision.
+	// The revision will be 0 if the requested ID did not exist.
+	GetCar(id string) (Car, uint64, error)
+
+	// SetCar stores the specified car at the given ID, returning the
+	// previous revision of the car (0 if it did not exist) and the new
+	// revision. The status of the car is not updated - the caller may
+	// wish to delete or modify the status of the car if the ID existed
+	// already. The caller must validate the ID before calling this
+	// method.
+	SetCar(id string, car Car, pre Precondition, author Author) (uint64, uint64, error)
+
+	// DeleteCar deletes the car, as well as any associated status. If the
+	// car with the given ID does not exist, this has no effect. The
+	// Precondition is checked against the revision of the car.
+	DeleteCar(id string, pre Precondition, author Author) error
+
+	// SetStatus overwrites the status for the specified car ID, returning
+	// the previous revision of the status (0 if it did not exist) and the
+	// new revision. It returns an error wrapping ErrCarNotFound if the
+	// specified ID does not exist in the cars list.
+	SetStatus(id string, status Status, pre Precondition, author Author) (uint64, uint64, error)
+
+	// GetStatus returns the status of the specified car and it's
+	// revision. The revision will be 0 if there was no status.
+	//
+	// The existence of a car does not imply the existence of a status.
+	GetStatus(id string) (Status, uint64, error)
+
+	// GetHistory returns every change made to the car with the specified
+	// ID and to it's status, oldest first. The history of a car is kept
+	// after it is deleted.
+	GetHistory(id string) ([]HistoryEntry, error)
+
+	// NextCarID returns the next valid unused car ID. IDs are allocated
+	// from a counter which is persisted along with the data, so the ID
+	// of a deleted car is never returned.
+	NextCarID() (string, error)
+
+	// Close flushes any pending writes and releases any resources held
+	// by the store. The store must not be used after it is closed.
+	Close() error
+}
 
 var validIDRegex = regexp.MustCompile("^car(0|([1-9][0-9]*))$")
 
-// Note that because we are using maps, and maps don't support concurrent
-// accesses, we need to use a mutex for any operation that manipulates these
-// maps, since we expect these methods to be used in a threaded context.
-var persistanceMutex = new(sync.Mutex)
+// ValidateID returns true if the given ID is valid. A car ID must be of the
+// form "carXXX" where "XXX" is an integer with no leading zeros
+func ValidateID(id string) bool {
+	return validIDRegex.MatchString(id)
+}
+
+// nextCarNumber returns the number following the highest of the given car
+// IDs, or 0 if there are none. It is an error for any of the IDs to be
+// invalid.
+func nextCarNumber(ids []string) (uint64, error) {
+	// Note that we can't simply sort the IDs, since "car10" sorts before
+	// "car9".
+	next := uint64(0)
+	for _, id := range ids {
+		if !ValidateID(id) {
+			return 0, fmt.Errorf("invalid car ID '%s'", id)
+		}
+
+		num, err := strconv.ParseUint(strings.TrimPrefix(id, "car"), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid car ID '%s': %w", id, err)
+		}
+
+		if num >= next {
+			next = num + 1
+		}
+	}
+
+	return next, nil
+}
+
+// sortedKeys returns the keys of the map in sorted order.
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
 
-var persistanceFile = "./data.json"
+// Assert compliance with CarStore
+var _ CarStore = (*JSONFileStore)(nil)
 
-func SetStorageDir(path string) error {
-	dinfo, err := os.Stat(path)
+// JSONFileStore is a CarStore which keeps all cars and statuses in memory,
+// and persists them using a JSON snapshot file plus a journal.
+//
+// Every mutation is appended to the journal, and fsynced, before the mutating
+// method returns. Periodically, the snapshot is rewritten to include all
+// journaled mutations, and the journal is emptied (see CompactEvery). When
+// loading, the snapshot is read and then the journal is replayed on top of
+// it.
+type JSONFileStore struct {
+	cars     map[string]Car
+	statuses map[string]Status
+
+	revision        uint64
+	carRevisions    map[string]uint64
+	statusRevisions map[string]uint64
+
+	history map[string][]HistoryEntry
+
+	// sequence is the sequence number of the last journal entry applied.
+	sequence uint64
+
+	// nextCarNumber is the number of the ID NextCarID will return.
+	nextCarNumber uint64
+
+	// Note that because we are using maps, and maps don't support
+	// concurrent accesses, we need to use a mutex for any operation that
+	// manipulates these maps, since we expect these methods to be used in
+	// a threaded context. The mutex also guards the journal.
+	mutex sync.Mutex
+
+	file        string
+	journalFile string
+	journal     *journal
+
+	// stop is closed, once, to stop the background compaction started by
+	// CompactEvery(), and compactor is done once it has stopped.
+	stop      chan struct{}
+	stopOnce  sync.Once
+	compactor sync.WaitGroup
+}
+
+// NewJSONFileStore instances a new, empty JSONFileStore which persists it's
+// data to the file "data.json" and the journal "data.json.journal" within
+// the directory dir. LoadFromDisk() must be called before the store is used.
+func NewJSONFileStore(dir string) (*JSONFileStore, error) {
+	dinfo, err := os.Stat(dir)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if !dinfo.IsDir() {
-		return fmt.Errorf("'%s' is not a directory", path)
+		return nil, fmt.Errorf("'%s' is not a directory", dir)
 	}
 
-	persistanceMutex.Lock()
-	defer persistanceMutex.Unlock()
-
-	persistanceFile = filepath.Join(path, "data.json")
-	return nil
+	file := filepath.Join(dir, "data.json")
+	return &JSONFileStore{
+		cars:            map[string]Car{},
+		statuses:        map[string]Status{},
+		carRevisions:    map[string]uint64{},
+		statusRevisions: map[string]uint64{},
+		history:         map[string][]HistoryEntry{},
+		file:            file,
+		journalFile:     file + ".journal",
+		stop:            make(chan struct{}),
+	}, nil
 }
 
-// SaveToDisk saves the persistance data to the disk.
-func SaveToDisk() {
-	persistanceMutex.Lock()
-	defer persistanceMutex.Unlock()
+// SaveToDisk writes a new snapshot of the persistance data to the disk, and
+// then empties the journal.
+func (s *JSONFileStore) SaveToDisk() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.compact()
+}
 
-	pd := &PersistanceData{Cars: persistanceCars, Statuses: persistanceStatuses}
+// compact implements SaveToDisk, the caller must hold the mutex.
+func (s *JSONFileStore) compact() (err error) {
+	start := time.Now()
+	defer func() {
+		storeSaveDuration.Observe(time.Since(start).Seconds())
+		if err != nil {
+			storeSaveFailures.Inc()
+		}
+	}()
+
+	pd := &PersistanceData{
+		Cars:            s.cars,
+		Statuses:        s.statuses,
+		Revision:        s.revision,
+		CarRevisions:    s.carRevisions,
+		StatusRevisions: s.statusRevisions,
+		History:         s.history,
+		JournalSequence: s.sequence,
+		NextCarNumber:   s.nextCarNumber,
+	}
 
 	raw, err := json.Marshal(pd)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	// TODO: allow configuring persistence location.
-	err = ioutil.WriteFile(persistanceFile+".new", raw, 0644)
+	err = writeFileSync(s.file+".new", raw)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	// File moves are (on most systems) atomic, so this mitigates the
 	// chances of ending up with a half-written data file.
-	os.Rename(persistanceFile+".new", persistanceFile)
+	err = os.Rename(s.file+".new", s.file)
+	if err != nil {
+		return err
+	}
+
+	// If we crash between the rename and the truncate, the journal will
+	// be replayed on top of a snapshot that already contains it. Replaying
+	// it again would duplicate the history it appends, so apply skips the
+	// entries whose sequence number the snapshot has already reached.
+	if s.journal != nil {
+		return s.journal.truncate()
+	}
+
+	return nil
 }
 
-// LoadFromDisk loads the persistence data from the disk.
-func LoadFromDisk() {
-	persistanceMutex.Lock()
-	defer persistanceMutex.Unlock()
+// writeFileSync is like ioutil.WriteFile, but fsyncs the file before
+// returning.
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
 
-	pd := &PersistanceData{}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
 
-	if _, err := os.Stat(persistanceFile); errors.Is(err, os.ErrNotExist) {
-		// the file does not exist
+	return err
+}
+
+// CompactEvery starts a background goroutine which writes a new snapshot,
+// and empties the journal, at the given interval if there have been any
+// mutations since the last snapshot. It runs until the store is closed. A
+// non-positive interval is ignored, leaving compaction to Close.
+//
+// Errors are logged rather than returned, since the journal still holds all
+// of the mutations, the next attempt can pick up where this one left off.
+func (s *JSONFileStore) CompactEvery(interval time.Duration) {
+	if interval <= 0 {
 		return
 	}
 
-	raw, err := ioutil.ReadFile(persistanceFile)
+	s.compactor.Add(1)
+	go func() {
+		defer s.compactor.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+			}
+
+			s.mutex.Lock()
+			if s.journal != nil && s.journal.entries > 0 {
+				if err := s.compact(); err != nil {
+					log.Printf("failed to compact '%s': %v\n", s.journalFile, err)
+				}
+			}
+			s.mutex.Unlock()
+		}
+	}()
+}
+
+// Close implements CarStore.Close. It stops background compaction, writes a
+// final snapshot, and closes the journal. Closing a store which is already
+// closed has no effect.
+func (s *JSONFileStore) Close() error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	s.compactor.Wait()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Either the store is already closed, or it was never loaded, in
+	// which case a snapshot would overwrite the data on disk.
+	if s.journal == nil {
+		return nil
+	}
+
+	err := s.compact()
+	if err != nil {
+		return err
+	}
+
+	err = s.journal.close()
+	s.journal = nil
+	return err
+}
+
+// LoadFromDisk loads the persistence data from the disk, replaying any
+// mutations from the journal which did not make it into the snapshot. If no
+// data has been persisted yet, the store is left empty.
+func (s *JSONFileStore) LoadFromDisk() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	pd := &PersistanceData{}
+
+	raw, err := ioutil.ReadFile(s.file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if err == nil {
+		err = json.Unmarshal(raw, pd)
+		if err != nil {
+			return fmt.Errorf("failed to parse '%s': %w", s.file, err)
+		}
+	}
+
+	err = pd.validateIDs()
+	if err != nil {
+		return fmt.Errorf("failed to load '%s': %w", s.file, err)
+	}
+
+	if pd.Cars != nil {
+		s.cars = pd.Cars
+	}
+
+	if pd.Statuses != nil {
+		s.statuses = pd.Statuses
+	}
+
+	if pd.CarRevisions != nil {
+		s.carRevisions = pd.CarRevisions
+	}
+
+	if pd.StatusRevisions != nil {
+		s.statusRevisions = pd.StatusRevisions
+	}
+
+	if pd.History != nil {
+		s.history = pd.History
+	}
+
+	s.revision = pd.Revision
+	s.sequence = pd.JournalSequence
+	s.nextCarNumber = pd.NextCarNumber
+
+	// Data written before the car ID counter was introduced won't have
+	// one, so we make sure it is past every car with a record or a
+	// history.
+	err = s.useCarIDs(append(sortedKeys(s.cars), sortedKeys(s.history)...))
+	if err != nil {
+		return err
+	}
+
+	// Data written before revisions were introduced won't have any, so
+	// we assign them here. Note that the IDs are sorted so that the
+	// revisions assigned don't depend on map iteration order.
+	for _, id := range sortedKeys(s.cars) {
+		if s.carRevisions[id] == 0 {
+			s.revision++
+			s.carRevisions[id] = s.revision
+		}
+	}
+
+	for _, id := range sortedKeys(s.statuses) {
+		if s.statusRevisions[id] == 0 {
+			s.revision++
+			s.statusRevisions[id] = s.revision
+		}
+	}
+
+	replayed, err := replayJournal(s.journalFile, s.apply)
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	if replayed > 0 {
+		log.Printf("replayed %d entries from '%s'\n", replayed, s.journalFile)
+	}
+
+	if s.journal != nil {
+		s.journal.close()
 	}
 
-	err = json.Unmarshal(raw, pd)
+	s.journal, err = openJournal(s.journalFile)
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	s.journal.entries = replayed
+	return nil
+}
+
+// apply applies a journal entry to the in-memory data, the caller must hold
+// the mutex.
+func (s *JSONFileStore) apply(e *journalEntry) error {
+	// Skip entries which the snapshot already captures. Journals written
+	// before sequence numbers were introduced won't have any, and are
+	// always replayed.
+	if e.Sequence != 0 && e.Sequence <= s.sequence {
+		return nil
+	}
+
+	if !ValidateID(e.ID) {
+		return fmt.Errorf("%s entry has invalid car ID '%s'", e.Op, e.ID)
+	}
+
+	// Journals written before revisions were introduced won't have any.
+	if e.Revision == 0 {
+		e.Revision = s.revision + 1
+	}
+
+	switch e.Op {
+	case journalSetCar:
+		if e.Car == nil {
+			return fmt.Errorf("%s entry for '%s' has no car", e.Op, e.ID)
+		}
+		s.cars[e.ID] = *e.Car
+		s.carRevisions[e.ID] = e.Revision
+
+		if err := s.useCarIDs([]string{e.ID}); err != nil {
+			return err
+		}
+
+	case journalDeleteCar:
+		delete(s.cars, e.ID)
+		delete(s.statuses, e.ID)
+		delete(s.carRevisions, e.ID)
+		delete(s.statusRevisions, e.ID)
+
+	case journalSetStatus:
+		if e.Status == nil {
+			return fmt.Errorf("%s entry for '%s' has no status", e.Op, e.ID)
+		}
+		s.statuses[e.ID] = *e.Status
+		s.statusRevisions[e.ID] = e.Revision
+
+	default:
+		return fmt.Errorf("unknown journal operation '%s'", e.Op)
+	}
+
+	if len(e.History) > 0 {
+		s.history[e.ID] = append(s.history[e.ID], e.History...)
+	}
+
+	if e.Revision > s.revision {
+		s.revision = e.Revision
+	}
+
+	if e.Sequence > s.sequence {
+		s.sequence = e.Sequence
 	}
 
-	persistanceCars = pd.Cars
-	persistanceStatuses = pd.Statuses
+	return nil
 }
 
-// GetCarIDs returns a list of all extant car IDs.
-func GetCarIDs() []string {
-	persistanceMutex.Lock()
-	defer persistanceMutex.Unlock()
+// useCarIDs advances the car ID counter past the given IDs, so that
+// NextCarID never returns them, the caller must hold the mutex.
+func (s *JSONFileStore) useCarIDs(ids []string) error {
+	next, err := nextCarNumber(ids)
+	if err != nil {
+		return err
+	}
+
+	if next > s.nextCarNumber {
+		s.nextCarNumber = next
+	}
+	return nil
+}
+
+// record durably journals the entry and then applies it, the caller must
+// hold the mutex. If journaling fails, the entry is not applied.
+func (s *JSONFileStore) record(e *journalEntry) error {
+	if s.journal == nil {
+		return fmt.Errorf("store has not been loaded, or has been closed")
+	}
+
+	e.Sequence = s.sequence + 1
+	err := s.journal.append(e)
+	if err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+
+	return s.apply(e)
+}
+
+// GetCarIDs implements CarStore.GetCarIDs.
+func (s *JSONFileStore) GetCarIDs() ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.carIDs(), nil
+}
+
+// carIDs returns the IDs of all cars, the caller must hold the mutex.
+func (s *JSONFileStore) carIDs() []string {
 	ids := []string{}
-	for key := range persistanceCars {
+	for key := range s.cars {
 		ids = append(ids, key)
 	}
 	return ids
 }
 
-// GetCar returns the car with the specified ID, and a boolean indicating if
-// the requested ID existed or not.
-func GetCar(id string) (Car, bool) {
-	persistanceMutex.Lock()
-	defer persistanceMutex.Unlock()
+// GetCar implements CarStore.GetCar.
+func (s *JSONFileStore) GetCar(id string) (Car, uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	car, ok := persistanceCars[id]
+	car, ok := s.cars[id]
 	if !ok {
-		return Car{}, false
+		return Car{}, 0, nil
 	}
 
-	return car, true
+	return car, s.carRevisions[id], nil
 }
 
-// ValidateID returns true if the given ID is valid. A car ID must be of the
-// form "carXXX" where "XXX" is an integer with no leading zeros
-func ValidateID(id string) bool {
-	return validIDRegex.MatchString(id)
-}
+// DeleteCar implements CarStore.DeleteCar.
+func (s *JSONFileStore) DeleteCar(id string, pre Precondition, author Author) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := pre.check(s.carRevisions[id])
+	if err != nil {
+		return err
+	}
+
+	e := &journalEntry{Op: journalDeleteCar, ID: id}
 
-// DeleteCar deletes the car, as well as any associated status. If the car
-// with the given ID does not exist, this has no effect.
-func DeleteCar(id string) {
-	persistanceMutex.Lock()
-	defer persistanceMutex.Unlock()
+	if car, ok := s.cars[id]; ok {
+		h, err := newHistoryEntry(author, HistoryCar, 0, car, nil)
+		if err != nil {
+			return err
+		}
+		e.History = append(e.History, h)
+	}
 
-	if _, ok := persistanceCars[id]; ok {
-		delete(persistanceCars, id)
+	if status, ok := s.statuses[id]; ok {
+		h, err := newHistoryEntry(author, HistoryStatus, 0, status, nil)
+		if err != nil {
+			return err
+		}
+		e.History = append(e.History, h)
 	}
 
-	if _, ok := persistanceStatuses[id]; ok {
-		delete(persistanceStatuses, id)
+	if len(e.History) == 0 {
+		// nothing to delete
+		return nil
 	}
-}
 
-// SetCar stores the specified car at the given ID, returning true if a car
-// with that ID already existed. The status of the car is not updated - the
-// caller may wish to delete or modify the status of the car if the ID existed
-// already. The caller must validate the ID before calling this function.
-func SetCar(id string, car Car) bool {
-	persistanceMutex.Lock()
-	defer persistanceMutex.Unlock()
+	return s.record(e)
+}
 
+// SetCar implements CarStore.SetCar.
+func (s *JSONFileStore) SetCar(id string, car Car, pre Precondition, author Author) (uint64, uint64, error) {
 	if !ValidateID(id) {
 		// This should never happen, since the caller is supposed to
 		// validate the ID.
-		panic(fmt.Sprintf("invalid ID passed to SetCar: '%s'", id))
+		return 0, 0, fmt.Errorf("invalid ID passed to SetCar: '%s'", id)
 	}
 
-	_, exists := persistanceCars[id]
-	persistanceCars[id] = car
-	return exists
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	prev := s.carRevisions[id]
+	err := pre.check(prev)
+	if err != nil {
+		return prev, 0, err
+	}
+
+	var previous *Car
+	if old, ok := s.cars[id]; ok {
+		previous = &old
+	}
+
+	rev := s.revision + 1
+	h, err := newHistoryEntry(author, HistoryCar, rev, previous, car)
+	if err != nil {
+		return prev, 0, err
+	}
+
+	err = s.record(&journalEntry{Op: journalSetCar, ID: id, Revision: rev, Car: &car, History: []HistoryEntry{h}})
+	if err != nil {
+		return prev, 0, err
+	}
+
+	return prev, rev, nil
 }
 
-// SetStatus overwrites the status for the specified car ID. It returns true
-// if the status already existed before (e.g. this was an overwrite). It return
-// an error if the specified ID does not exist in the cars list.
-func SetStatus(id string, status Status) (bool, error) {
-	persistanceMutex.Lock()
-	defer persistanceMutex.Unlock()
+// SetStatus implements CarStore.SetStatus.
+func (s *JSONFileStore) SetStatus(id string, status Status, pre Precondition, author Author) (uint64, uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	if _, ok := persistanceCars[id]; !ok {
-		return false, fmt.Errorf("cannot set status of non-existent car '%s'", id)
+	if _, ok := s.cars[id]; !ok {
+		return 0, 0, fmt.Errorf("cannot set status of car '%s': %w", id, ErrCarNotFound)
 	}
 
-	_, exists := persistanceStatuses[id]
-	persistanceStatuses[id] = status
-	return exists, nil
+	prev := s.statusRevisions[id]
+	err := pre.check(prev)
+	if err != nil {
+		return prev, 0, err
+	}
+
+	var previous *Status
+	if old, ok := s.statuses[id]; ok {
+		previous = &old
+	}
+
+	rev := s.revision + 1
+	h, err := newHistoryEntry(author, HistoryStatus, rev, previous, status)
+	if err != nil {
+		return prev, 0, err
+	}
+
+	err = s.record(&journalEntry{Op: journalSetStatus, ID: id, Revision: rev, Status: &status, History: []HistoryEntry{h}})
+	if err != nil {
+		return prev, 0, err
+	}
+
+	return prev, rev, nil
 }
 
-// GetStatus returns the status of the specified car if one exists. The bool
-// will be true if the status existed.
-//
-// The existence of a car does not imply the existence of a status.
-func GetStatus(id string) (Status, bool) {
-	persistanceMutex.Lock()
-	defer persistanceMutex.Unlock()
+// GetStatus implements CarStore.GetStatus.
+func (s *JSONFileStore) GetStatus(id string) (Status, uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	status, ok := persistanceStatuses[id]
+	status, ok := s.statuses[id]
 	if !ok {
-		return Status{}, false
+		return Status{}, 0, nil
 	}
 
-	return status, true
+	return status, s.statusRevisions[id], nil
 }
 
-// NextCarID returns the next valid unused car ID.
-func NextCarID() string {
-	ids := GetCarIDs()
-	if len(ids) == 0 {
-		return "car0"
-	}
+// GetHistory implements CarStore.GetHistory.
+func (s *JSONFileStore) GetHistory(id string) ([]HistoryEntry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	sort.Strings(ids)
+	history := make([]HistoryEntry, len(s.history[id]))
+	copy(history, s.history[id])
+	return history, nil
+}
 
-	persistanceMutex.Lock()
-	defer persistanceMutex.Unlock()
+// NextCarID implements CarStore.NextCarID.
+func (s *JSONFileStore) NextCarID() (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	lastID := ids[len(ids)-1]
-	lastIDNumS := strings.Replace(lastID, "car", "", -1)
-	lastIDNum, err := strconv.Atoi(lastIDNumS)
-	if err != nil {
-		// This should never happen, because we control the set of
-		// allowed car IDs.
-		panic(err)
-	}
-
-	// Just in case the given ID already somehow exists, keep incrementing
-	// the number until we find an unused one.
-	for {
-		lastIDNum++
-		newID := fmt.Sprintf("car%d", lastIDNum)
-		if _, ok := persistanceCars[newID]; !ok {
-			return newID
-		}
-	}
+	return fmt.Sprintf("car%d", s.nextCarNumber), nil
 }
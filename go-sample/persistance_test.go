@@ -0,0 +1,287 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// loadJSONFileStore opens the JSONFileStore in dir.
+func loadJSONFileStore(t *testing.T, dir string) *JSONFileStore {
+	t.Helper()
+
+	s, err := NewJSONFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.LoadFromDisk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// crash abandons the store without writing a final snapshot, as if the
+// process had died.
+func crash(t *testing.T, s *JSONFileStore) {
+	t.Helper()
+
+	s.stopOnce.Do(func() { close(s.stop) })
+	if err := s.journal.close(); err != nil {
+		t.Fatal(err)
+	}
+	s.journal = nil
+}
+
+func TestJSONFileStoreReplaysJournal(t *testing.T) {
+	dir := t.TempDir()
+	author := Author{Subject: "alice"}
+
+	s := loadJSONFileStore(t, dir)
+	_, rev, err := s.SetCar("car0", Car{Make: "Honda"}, nil, author)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = s.SetStatus("car0", Status{Ready: true}, nil, author)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash(t, s)
+
+	s = loadJSONFileStore(t, dir)
+	defer s.Close()
+
+	car, carRev, err := s.GetCar("car0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if car.Make != "Honda" || carRev != rev {
+		t.Errorf("expected car0 at revision %d, got %+v at revision %d", rev, car, carRev)
+	}
+
+	history, err := s.GetHistory("car0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 {
+		t.Errorf("expected 2 history entries, got %d", len(history))
+	}
+}
+
+func TestJSONFileStoreReplayIsIdempotent(t *testing.T) {
+	dir := t.TempDir()
+	author := Author{Subject: "alice"}
+
+	s := loadJSONFileStore(t, dir)
+	_, _, err := s.SetCar("car0", Car{Make: "Honda"}, nil, author)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = s.SetCar("car1", Car{Make: "Ford"}, nil, author)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.DeleteCar("car1", nil, author)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash between writing the snapshot and truncating the
+	// journal, by putting the compacted entries back. A later entry,
+	// which is not in the snapshot, must still be replayed.
+	compacted, err := os.ReadFile(s.journalFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.SaveToDisk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = s.SetStatus("car0", Status{Sold: true}, nil, author)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	later, err := os.ReadFile(s.journalFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]HistoryEntry{}
+	for _, id := range []string{"car0", "car1"} {
+		expected[id], err = s.GetHistory(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	revision := s.revision
+	crash(t, s)
+
+	err = os.WriteFile(s.journalFile, append(compacted, later...), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		s = loadJSONFileStore(t, dir)
+
+		for id, entries := range expected {
+			history, err := s.GetHistory(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(history, entries) {
+				t.Errorf("load %d: expected %d history entries for %s, got %d", i, len(entries), id, len(history))
+			}
+		}
+
+		status, _, err := s.GetStatus("car0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !status.Sold {
+			t.Errorf("load %d: entry after the snapshot was not replayed", i)
+		}
+
+		if s.revision != revision {
+			t.Errorf("load %d: expected revision %d, got %d", i, revision, s.revision)
+		}
+
+		// Crash again without compacting, so that the next load
+		// replays the same journal once more.
+		crash(t, s)
+	}
+}
+
+func TestNextCarNumber(t *testing.T) {
+	for _, test := range []struct {
+		ids      []string
+		expected uint64
+	}{
+		{nil, 0},
+		{[]string{"car0"}, 1},
+		{[]string{"car9", "car10", "car2"}, 11},
+	} {
+		next, err := nextCarNumber(test.ids)
+		if err != nil || next != test.expected {
+			t.Errorf("%v: expected %d, got %d, %v", test.ids, test.expected, next, err)
+		}
+	}
+
+	for _, ids := range [][]string{{"car0", "bogus"}, {"car01"}, {"car"}} {
+		if next, err := nextCarNumber(ids); err == nil {
+			t.Errorf("%v: expected an error, got %d", ids, next)
+		}
+	}
+}
+
+func TestJSONFileStoreRejectsInvalidIDs(t *testing.T) {
+	for name, files := range map[string]map[string]string{
+		"snapshot car":     {"data.json": `{"cars": {"bogus": {"make": "Honda"}}}`},
+		"snapshot status":  {"data.json": `{"statuses": {"car01": {"ready": true}}}`},
+		"snapshot history": {"data.json": `{"history": {"bogus": []}}`},
+		"journal":          {"data.json.journal": `{"op": "set-car", "id": "bogus", "seq": 1, "car": {"make": "Honda"}}` + "\n"},
+	} {
+		dir := t.TempDir()
+		for file, content := range files {
+			err := os.WriteFile(filepath.Join(dir, file), []byte(content), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		s, err := NewJSONFileStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.LoadFromDisk(); err == nil {
+			t.Errorf("%s: expected loading an invalid car ID to fail", name)
+		}
+	}
+}
+
+func TestJSONFileStoreNeverReusesCarIDs(t *testing.T) {
+	dir := t.TempDir()
+	author := Author{Subject: "alice"}
+
+	s := loadJSONFileStore(t, dir)
+	for _, id := range []string{"car0", "car1"} {
+		_, _, err := s.SetCar(id, Car{Make: "Honda"}, nil, author)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := s.DeleteCar("car1", nil, author)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The counter must be restored both from the journal and from the
+	// snapshot.
+	crash(t, s)
+	for i := 0; i < 2; i++ {
+		s = loadJSONFileStore(t, dir)
+
+		id, err := s.NextCarID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != "car2" {
+			t.Errorf("load %d: expected car2, got %s", i, id)
+		}
+
+		err = s.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestJSONFileStoreCloseTwice(t *testing.T) {
+	dir := t.TempDir()
+
+	s := loadJSONFileStore(t, dir)
+	s.CompactEvery(time.Hour)
+	_, _, err := s.SetCar("car0", Car{Make: "Honda"}, nil, Author{Subject: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := s.Close(); err != nil {
+			t.Fatalf("close %d: %v", i, err)
+		}
+	}
+
+	s = loadJSONFileStore(t, dir)
+	defer s.Close()
+
+	car, _, err := s.GetCar("car0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if car.Make != "Honda" {
+		t.Errorf("expected the car to survive closing twice, got %+v", car)
+	}
+}
+
+func TestJSONFileStoreCompactEveryIgnoresNonPositiveIntervals(t *testing.T) {
+	s := loadJSONFileStore(t, t.TempDir())
+	s.CompactEvery(0)
+	s.CompactEvery(-time.Second)
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
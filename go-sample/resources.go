@@ -0,0 +1,96 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+// ResourceAttributeFunc returns the attributes of the resource at the given
+// path, which are passed to OPA in the resource-attributes field of the
+// EntitlementsInput. It returns nil if the path does not refer to a resource
+// with attributes. The context is that of the request being authorized.
+type ResourceAttributeFunc func(ctx context.Context, resource string) (map[string]string, error)
+
+// carIDFromResource returns the ID of the car that the path refers to, i.e.
+// the ID in /cars/{id}, /cars/{id}/status or /cars/{id}/history. The bool
+// is false if the path does not refer to a car.
+func carIDFromResource(resource string) (string, bool) {
+	segments := strings.Split(strings.Trim(resource, "/"), "/")
+	if len(segments) < 2 || len(segments) > 3 || segments[0] != "cars" {
+		return "", false
+	}
+
+	if !ValidateID(segments[1]) {
+		return "", false
+	}
+
+	return segments[1], true
+}
+
+// CarAttributes returns a ResourceAttributeFunc which looks up the car that
+// each path refers to in the store. The attributes of a car are its make,
+// model, year and color, along with whether it is sold and ready, and its
+// price, if it has a status. Cars which do not exist have no attributes.
+//
+// Every attribute is passed to OPA, even if the field it holds is protected
+// (see WithFieldEntitlements), since the policy may need it. Protected
+// attributes should be masked in the decision and shadow logs, with the paths
+// returned by CarAttributeMasks.
+//
+// Each lookup is traced as part of the request's trace, just like the
+// store operations made by the API handlers.
+func CarAttributes(store CarStore) ResourceAttributeFunc {
+	return func(ctx context.Context, resource string) (map[string]string, error) {
+		id, ok := carIDFromResource(resource)
+		if !ok {
+			return nil, nil
+		}
+
+		store := &tracedStore{store: store, ctx: ctx}
+
+		car, rev, err := store.GetCar(id)
+		if err != nil || rev == 0 {
+			return nil, err
+		}
+
+		attributes := map[string]string{
+			"id":    id,
+			"make":  car.Make,
+			"model": car.Model,
+			"year":  strconv.Itoa(car.Year),
+			"color": car.Color,
+		}
+
+		status, rev, err := store.GetStatus(id)
+		if err != nil {
+			return nil, err
+		}
+
+		if rev != 0 {
+			attributes["sold"] = strconv.FormatBool(status.Sold)
+			attributes["ready"] = strconv.FormatBool(status.Ready)
+			attributes["price"] = strconv.FormatFloat(float64(status.Price), 'f', -1, 32)
+		}
+
+		return attributes, nil
+	}
+}
+
+// CarAttributeMasks returns the paths of the attributes given by
+// CarAttributes which hold any of the protected fields, such as
+// "status.price", so that they can be masked in logged inputs.
+func CarAttributeMasks(protected []string) []ResultPath {
+	masks := []ResultPath{}
+	for _, field := range protected {
+		_, name, ok := strings.Cut(field, ".")
+		if ok && name != "" {
+			masks = append(masks, ResultPath{"resource-attributes", name})
+		}
+	}
+	return masks
+}
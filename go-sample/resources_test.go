@@ -0,0 +1,94 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+)
+
+func TestCarAttributes(t *testing.T) {
+	store := loadJSONFileStore(t, t.TempDir())
+	defer store.Close()
+
+	author := Author{Subject: "alice"}
+	_, _, err := store.SetCar("car0", Car{Make: "Honda", Model: "Accord", Year: 2017, Color: "red"}, nil, author)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = store.SetStatus("car0", Status{Ready: true, Price: 9999.5}, nil, author)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ended := recordSpans()
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "request")
+	defer parent.End()
+
+	attributes := CarAttributes(store)
+
+	for _, resource := range []string{"/cars/car0", "/cars/car0/status", "/cars/car0/history"} {
+		got, err := attributes(ctx, resource)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := map[string]string{
+			"id":    "car0",
+			"make":  "Honda",
+			"model": "Accord",
+			"year":  "2017",
+			"color": "red",
+			"sold":  "false",
+			"ready": "true",
+			"price": "9999.5",
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: expected %v, got %v", resource, expected, got)
+		}
+	}
+
+	for _, resource := range []string{"/cars", "/cars/car1", "/cars/bogus", "/other/car0"} {
+		got, err := attributes(ctx, resource)
+		if err != nil || got != nil {
+			t.Errorf("%s: expected no attributes, got %v, %v", resource, got, err)
+		}
+	}
+
+	spans := ended()
+	if len(spans) == 0 {
+		t.Fatal("expected the lookups to be traced")
+	}
+	for _, span := range spans {
+		if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("span %s is not a child of the request's span", span.Name())
+		}
+	}
+}
+
+func TestCarAttributeMasks(t *testing.T) {
+	masks := CarAttributeMasks([]string{"status.price", "car.color"})
+	expected := []ResultPath{{"resource-attributes", "price"}, {"resource-attributes", "color"}}
+	if !reflect.DeepEqual(masks, expected) {
+		t.Fatalf("expected %v, got %v", expected, masks)
+	}
+
+	input := &EntitlementsInput{
+		Subject:           "alice",
+		ResourceAttribute: map[string]string{"id": "car0", "price": "9999.5", "color": "red"},
+	}
+	masked, err := maskPaths(input, masks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attributes := masked.(map[string]interface{})["resource-attributes"].(map[string]interface{})
+	if attributes["price"] != maskedValue || attributes["color"] != maskedValue || attributes["id"] != "car0" {
+		t.Errorf("unexpected masked attributes %v", attributes)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maskedValue replaces the values at the mask paths of logged inputs.
+const maskedValue = "**REDACTED**"
+
+// ResultPath identifies a value within an OPA result. Each element is either
+// an object key, or an array index.
+type ResultPath []string
+
+// ParseResultPath parses a path such as "outcome/allow", "outcome.allow" or
+// "outcome.enforced[0].allowed". Elements may be separated by either "/" or
+// ".", and array indexes may be given either in brackets or as elements of
+// their own, e.g. "outcome/enforced/0/allowed". Empty elements are ignored,
+// so the empty path refers to the result itself, which is useful for policies
+// that return a bare boolean.
+func ParseResultPath(path string) (ResultPath, error) {
+	p := ResultPath{}
+
+	elements := strings.FieldsFunc(path, func(r rune) bool {
+		return r == '/' || r == '.'
+	})
+
+	for _, element := range elements {
+		key, rest, _ := strings.Cut(element, "[")
+		if key != "" {
+			p = append(p, key)
+		}
+
+		if rest == "" {
+			if strings.Contains(element, "[") || strings.Contains(element, "]") {
+				return nil, fmt.Errorf("malformed element '%s' in result path '%s'", element, path)
+			}
+			continue
+		}
+
+		// Each remaining index is of the form "N]", except the first
+		// which has already had its "[" removed.
+		for _, index := range strings.Split("["+rest, "[")[1:] {
+			n := strings.TrimSuffix(index, "]")
+			if n == index {
+				return nil, fmt.Errorf("malformed element '%s' in result path '%s'", element, path)
+			}
+
+			if _, err := strconv.Atoi(n); err != nil {
+				return nil, fmt.Errorf("invalid array index '%s' in result path '%s'", n, path)
+			}
+
+			p = append(p, n)
+		}
+	}
+
+	return p, nil
+}
+
+// Lookup returns the value at the path within the result, which should be
+// decoded JSON. The bool is false if the path does not exist in the result.
+func (p ResultPath) Lookup(result interface{}) (interface{}, bool) {
+	value := result
+	for _, element := range p {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			nested, ok := v[element]
+			if !ok {
+				return nil, false
+			}
+			value = nested
+
+		case []interface{}:
+			i, err := strconv.Atoi(element)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+
+		default:
+			// Cannot subscript further, since the nested value is
+			// neither an object nor an array.
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+// Build returns a result in which value is at the path, and which contains
+// nothing else. Numeric elements are treated as array indexes.
+func (p ResultPath) Build(value interface{}) interface{} {
+	for i := len(p) - 1; i >= 0; i-- {
+		if n, err := strconv.Atoi(p[i]); err == nil && n >= 0 {
+			array := make([]interface{}, n+1)
+			array[n] = value
+			value = array
+			continue
+		}
+
+		value = map[string]interface{}{p[i]: value}
+	}
+
+	return value
+}
+
+// String returns the path in dotted form.
+func (p ResultPath) String() string {
+	return strings.Join(p, ".")
+}
+
+// maskPaths returns a copy of the input with the values at each of the mask
+// paths replaced, so that secrets such as bearer tokens are not written to
+// the decision and shadow logs.
+func maskPaths(input interface{}, masks []ResultPath) (interface{}, error) {
+	if len(masks) == 0 {
+		return input, nil
+	}
+
+	// Round trip the input through JSON, both to copy it and so that
+	// the mask paths can be looked up in it.
+	raw, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+
+	var masked interface{}
+	err = json.Unmarshal(raw, &masked)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range masks {
+		if len(path) == 0 {
+			return maskedValue, nil
+		}
+
+		parent, ok := path[:len(path)-1].Lookup(masked)
+		if !ok {
+			continue
+		}
+
+		// Empty values are left alone, since they reveal nothing and
+		// masking them would suggest they were set.
+		last := path[len(path)-1]
+		switch v := parent.(type) {
+		case map[string]interface{}:
+			if value, ok := v[last]; ok && value != nil && value != "" {
+				v[last] = maskedValue
+			}
+
+		case []interface{}:
+			i, err := strconv.Atoi(last)
+			if err == nil && i >= 0 && i < len(v) && v[i] != nil && v[i] != "" {
+				v[i] = maskedValue
+			}
+		}
+	}
+
+	return masked, nil
+}
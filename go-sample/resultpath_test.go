@@ -0,0 +1,122 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseResultPath(t *testing.T) {
+	for _, test := range []struct {
+		path     string
+		expected ResultPath
+	}{
+		{"", ResultPath{}},
+		{"/", ResultPath{}},
+		{"allow", ResultPath{"allow"}},
+		{"outcome/allow", ResultPath{"outcome", "allow"}},
+		{"outcome.allow", ResultPath{"outcome", "allow"}},
+		{"/outcome//allow/", ResultPath{"outcome", "allow"}},
+		{"outcome.enforced[0].allowed", ResultPath{"outcome", "enforced", "0", "allowed"}},
+		{"outcome/enforced/0/allowed", ResultPath{"outcome", "enforced", "0", "allowed"}},
+		{"matrix[1][2]", ResultPath{"matrix", "1", "2"}},
+		{"[3]", ResultPath{"3"}},
+	} {
+		p, err := ParseResultPath(test.path)
+		if err != nil {
+			t.Errorf("'%s': unexpected error: %v", test.path, err)
+			continue
+		}
+		if !reflect.DeepEqual(p, test.expected) {
+			t.Errorf("'%s': expected %q, got %q", test.path, test.expected, p)
+		}
+	}
+}
+
+func TestParseResultPathErrors(t *testing.T) {
+	for _, path := range []string{
+		"outcome]",
+		"outcome[0",
+		"outcome[x]",
+		"outcome[]",
+		"outcome[0]x",
+		"outcome[0]]",
+	} {
+		if p, err := ParseResultPath(path); err == nil {
+			t.Errorf("'%s': expected an error, got %q", path, p)
+		}
+	}
+}
+
+func TestResultPathLookup(t *testing.T) {
+	var result interface{}
+	err := json.Unmarshal([]byte(`{
+		"allow": true,
+		"outcome": {"enforced": [{"allowed": false}, {"allowed": true}]},
+		"scalar": 5
+	}`), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		path     string
+		expected interface{}
+		ok       bool
+	}{
+		{"allow", true, true},
+		{"outcome.enforced[1].allowed", true, true},
+		{"outcome.enforced[0].allowed", false, true},
+		{"outcome/enforced/0/allowed", false, true},
+		{"", result, true},
+		{"missing", nil, false},
+		{"outcome.enforced[2].allowed", nil, false},
+		{"outcome.enforced[-1].allowed", nil, false},
+		{"outcome.enforced.first", nil, false},
+		{"scalar.nested", nil, false},
+	} {
+		p, err := ParseResultPath(test.path)
+		if err != nil {
+			t.Fatalf("'%s': %v", test.path, err)
+		}
+
+		value, ok := p.Lookup(result)
+		if ok != test.ok || !reflect.DeepEqual(value, test.expected) {
+			t.Errorf("'%s': expected %v, %v, got %v, %v", test.path, test.expected, test.ok, value, ok)
+		}
+	}
+}
+
+func TestResultPathBuild(t *testing.T) {
+	p, err := ParseResultPath("outcome.enforced[1].allowed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := p.Build(true)
+	expected := map[string]interface{}{
+		"outcome": map[string]interface{}{
+			"enforced": []interface{}{nil, map[string]interface{}{"allowed": true}},
+		},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+
+	// Whatever Build returns, Lookup must find the value in it.
+	if value, ok := p.Lookup(result); !ok || value != true {
+		t.Errorf("Lookup of the built result gave %v, %v", value, ok)
+	}
+
+	if value := (ResultPath{}).Build(false); value != false {
+		t.Errorf("expected the empty path to build the bare value, got %v", value)
+	}
+
+	if s := p.String(); s != "outcome.enforced.1.allowed" {
+		t.Errorf("unexpected String() %s", s)
+	}
+}
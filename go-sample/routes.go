@@ -0,0 +1,123 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// RouteTemplate matches requests by method and path, using the same
+// "{variable}" syntax as the API's routes, e.g. "PUT /cars/{id}/status"
+// matches PUT requests to the status of any car. The method is optional, in
+// which case requests with any method match.
+type RouteTemplate struct {
+	method   string
+	segments []string
+}
+
+// ParseRouteTemplate parses a route template of the form
+// "[METHOD ]/path/{variable}/...".
+func ParseRouteTemplate(s string) (RouteTemplate, error) {
+	t := RouteTemplate{}
+
+	path := strings.TrimSpace(s)
+	if method, rest, ok := strings.Cut(path, " "); ok {
+		t.method = strings.ToUpper(method)
+		path = strings.TrimSpace(rest)
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		return t, fmt.Errorf("route template '%s' must start with a method or '/'", s)
+	}
+
+	t.segments = strings.Split(strings.Trim(path, "/"), "/")
+	for _, segment := range t.segments {
+		if strings.HasPrefix(segment, "{") != strings.HasSuffix(segment, "}") {
+			return t, fmt.Errorf("malformed variable '%s' in route template '%s'", segment, s)
+		}
+	}
+
+	return t, nil
+}
+
+// Matches returns true if the request matches the template.
+func (t RouteTemplate) Matches(r *http.Request) bool {
+	if t.method != "" && t.method != r.Method {
+		return false
+	}
+
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(segments) != len(t.segments) {
+		return false
+	}
+
+	for i, segment := range t.segments {
+		if strings.HasPrefix(segment, "{") {
+			if segments[i] == "" {
+				return false
+			}
+			continue
+		}
+
+		if segment != segments[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Path returns the path of the template, without the method.
+func (t RouteTemplate) Path() string {
+	return "/" + strings.Join(t.segments, "/")
+}
+
+// String returns the template in the form it was parsed from.
+func (t RouteTemplate) String() string {
+	path := t.Path()
+	if t.method == "" {
+		return path
+	}
+	return t.method + " " + path
+}
+
+// RouteTemplates is a list of RouteTemplates.
+type RouteTemplates []RouteTemplate
+
+// ParseRouteTemplates parses each of the route templates.
+func ParseRouteTemplates(templates []string) (RouteTemplates, error) {
+	ts := RouteTemplates{}
+	for _, s := range templates {
+		t, err := ParseRouteTemplate(s)
+		if err != nil {
+			return nil, err
+		}
+		ts = append(ts, t)
+	}
+	return ts, nil
+}
+
+// Match returns the first of the templates which the request matches. The
+// bool is false if it matches none of them.
+func (ts RouteTemplates) Match(r *http.Request) (RouteTemplate, bool) {
+	for _, t := range ts {
+		if t.Matches(r) {
+			return t, true
+		}
+	}
+	return RouteTemplate{}, false
+}
+
+// Matches returns true if the request matches any of the templates.
+func (ts RouteTemplates) Matches(r *http.Request) bool {
+	for _, t := range ts {
+		if t.Matches(r) {
+			return true
+		}
+	}
+	return false
+}
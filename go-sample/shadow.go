@@ -0,0 +1,300 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Assert compliance with OPADecider and BatchOPADecider
+var _ OPADecider = (*ShadowDecider)(nil)
+var _ BatchOPADecider = (*ShadowDecider)(nil)
+
+// shadowQueueSize bounds the number of shadow evaluations which may be
+// waiting to run. If the shadow decider falls further behind than this,
+// evaluations are dropped rather than slowing down the primary.
+const shadowQueueSize = 1024
+
+// shadowWorkers is the number of shadow evaluations which run at once.
+const shadowWorkers = 4
+
+// ShadowDecider returns the decisions of a primary OPADecider, while also
+// asking a shadow OPADecider for a decision on the same input in the
+// background. This allows a new policy to be compared against the one which
+// is being enforced, using live traffic, before it is promoted.
+//
+// Whenever the two disagree on whether the input is allowed, a
+// ShadowDisagreement is written as a line of JSON to the disagreements
+// writer, with the values at the mask paths replaced in its input, as for
+// DecisionLogger.
+type ShadowDecider struct {
+	primary   OPADecider
+	shadow    OPADecider
+	allowPath ResultPath
+	timeout   time.Duration
+	masks     []ResultPath
+
+	queue chan *shadowEvaluation
+	wg    sync.WaitGroup
+
+	// queueMutex guards closed, which is set once the queue has been
+	// closed. Requests may still be in flight when Close() is called, for
+	// example if the server's shutdown timed out, so enqueue must not
+	// send on the queue after that.
+	queueMutex sync.RWMutex
+	closed     bool
+
+	mutex         sync.Mutex
+	disagreements io.Writer
+	stats         ShadowStats
+}
+
+// shadowEvaluation is a single input for which the shadow decider should be
+// consulted, along with the decision the primary made.
+type shadowEvaluation struct {
+	input   interface{}
+	primary *OPADecision
+
+	// link is the span in which the primary decision was made, so that
+	// the shadow evaluation can be traced back to it.
+	link trace.SpanContext
+}
+
+// ShadowStats counts the outcomes of a ShadowDecider's shadow evaluations.
+type ShadowStats struct {
+	Compared  uint64 `json:"compared"`
+	Agreed    uint64 `json:"agreed"`
+	Disagreed uint64 `json:"disagreed"`
+	Errors    uint64 `json:"errors"`
+	Dropped   uint64 `json:"dropped"`
+}
+
+// ShadowDisagreement records an input on which the primary and shadow
+// deciders disagreed.
+type ShadowDisagreement struct {
+	Timestamp time.Time      `json:"timestamp"`
+	Input     interface{}    `json:"input"`
+	Primary   ShadowDecision `json:"primary"`
+	Shadow    ShadowDecision `json:"shadow"`
+}
+
+// ShadowDecision summarizes one side of a ShadowDisagreement.
+type ShadowDecision struct {
+	DecisionID string      `json:"decision_id"`
+	Allowed    bool        `json:"allowed"`
+	Result     interface{} `json:"result"`
+}
+
+// NewShadowDecider instances an OPADecider which enforces the decisions of
+// primary, and compares them with those of shadow. Whether each decision
+// allows the input is determined using allowPath, as for
+// WithAllowPath(). Each shadow decision may take up to timeout. Values at
+// each of the mask paths are masked in the inputs written to disagreements.
+//
+// Close() should be called once the decider is no longer needed, to wait
+// for any outstanding shadow evaluations.
+func NewShadowDecider(primary, shadow OPADecider, allowPath ResultPath, timeout time.Duration, disagreements io.Writer, masks []ResultPath) *ShadowDecider {
+	d := &ShadowDecider{
+		primary:       primary,
+		shadow:        shadow,
+		allowPath:     allowPath,
+		timeout:       timeout,
+		masks:         masks,
+		queue:         make(chan *shadowEvaluation, shadowQueueSize),
+		disagreements: disagreements,
+	}
+
+	for i := 0; i < shadowWorkers; i++ {
+		d.wg.Add(1)
+		go d.work()
+	}
+
+	return d
+}
+
+// Decision implements OPADecider.Decision.
+func (d *ShadowDecider) Decision(ctx context.Context, input interface{}) (*OPADecision, error) {
+	decision, err := d.primary.Decision(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	d.enqueue(ctx, input, decision)
+	return decision, nil
+}
+
+// Decisions implements BatchOPADecider.Decisions. The shadow decider is
+// consulted on each input individually.
+func (d *ShadowDecider) Decisions(ctx context.Context, inputs []interface{}) ([]*OPADecision, error) {
+	decisions, err := Decisions(ctx, d.primary, inputs)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, input := range inputs {
+		d.enqueue(ctx, input, decisions[i])
+	}
+
+	return decisions, nil
+}
+
+// enqueue schedules a shadow evaluation, unless too many are already
+// waiting or the decider has been closed.
+func (d *ShadowDecider) enqueue(ctx context.Context, input interface{}, primary *OPADecision) {
+	e := &shadowEvaluation{
+		input:   input,
+		primary: primary,
+		link:    trace.SpanContextFromContext(ctx),
+	}
+
+	d.queueMutex.RLock()
+	defer d.queueMutex.RUnlock()
+
+	if !d.closed {
+		select {
+		case d.queue <- e:
+			return
+		default:
+		}
+	}
+
+	d.mutex.Lock()
+	d.stats.Dropped++
+	d.mutex.Unlock()
+}
+
+// work runs shadow evaluations until the queue is closed.
+func (d *ShadowDecider) work() {
+	defer d.wg.Done()
+
+	for e := range d.queue {
+		err := d.compare(e)
+		if err != nil {
+			log.Printf("shadow evaluation for primary decision %s failed: %v\n", e.primary.ID, err)
+
+			d.mutex.Lock()
+			d.stats.Errors++
+			d.mutex.Unlock()
+		}
+	}
+}
+
+// allowed extracts whether the decision allows the input.
+func (d *ShadowDecider) allowed(decision *OPADecision) (bool, error) {
+	value, ok := d.allowPath.Lookup(decision.Result)
+	if !ok {
+		return false, fmt.Errorf("result of decision %s does not contain allow path '%s'", decision.ID, d.allowPath)
+	}
+
+	allowed, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("value at allow path '%s' in result of decision %s is not a boolean", d.allowPath, decision.ID)
+	}
+
+	return allowed, nil
+}
+
+// compare asks the shadow decider about the evaluation's input, and records
+// the outcome.
+func (d *ShadowDecider) compare(e *shadowEvaluation) (err error) {
+	// The request the primary decision was made for has usually finished
+	// by now, so the evaluation starts a trace of its own, linked to it.
+	ctx, span := tracer.Start(context.Background(), "ShadowDecider.compare", trace.WithLinks(trace.Link{SpanContext: e.link}))
+	defer func() { endSpan(span, err) }()
+
+	primaryAllowed, err := d.allowed(e.primary)
+	if err != nil {
+		return err
+	}
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	shadow, err := d.shadow.Decision(ctx, e.input)
+	observeDecision("shadow", start, err)
+	if err != nil {
+		return err
+	}
+
+	shadowAllowed, err := d.allowed(shadow)
+	if err != nil {
+		return err
+	}
+
+	span.SetAttributes(attribute.Bool("shadow.agreed", primaryAllowed == shadowAllowed))
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.stats.Compared++
+	if primaryAllowed == shadowAllowed {
+		d.stats.Agreed++
+		return nil
+	}
+	d.stats.Disagreed++
+
+	log.Printf("shadow decision %s (allowed=%v) disagrees with primary decision %s (allowed=%v)\n", shadow.ID, shadowAllowed, e.primary.ID, primaryAllowed)
+
+	input, err := maskPaths(e.input, d.masks)
+	if err != nil {
+		return fmt.Errorf("failed to mask input of decision %s: %w", e.primary.ID, err)
+	}
+
+	raw, err := json.Marshal(&ShadowDisagreement{
+		Timestamp: time.Now().UTC(),
+		Input:     input,
+		Primary: ShadowDecision{
+			DecisionID: e.primary.ID,
+			Allowed:    primaryAllowed,
+			Result:     e.primary.Result,
+		},
+		Shadow: ShadowDecision{
+			DecisionID: shadow.ID,
+			Allowed:    shadowAllowed,
+			Result:     shadow.Result,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = d.disagreements.Write(append(raw, '\n'))
+	return err
+}
+
+// Stats returns the ShadowDecider's counters.
+func (d *ShadowDecider) Stats() ShadowStats {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.stats
+}
+
+// Close waits for outstanding shadow evaluations to finish. Decisions may
+// still be requested afterwards, but are no longer compared with the shadow
+// decider.
+func (d *ShadowDecider) Close() error {
+	d.queueMutex.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.queue)
+	}
+	d.queueMutex.Unlock()
+
+	d.wg.Wait()
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// lockedBuffer is a bytes.Buffer which is safe for concurrent use.
+type lockedBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+// newDisagreeingShadowDecider returns a ShadowDecider whose primary always
+// allows, and whose shadow always denies.
+func newDisagreeingShadowDecider(disagreements *lockedBuffer, masks []ResultPath) *ShadowDecider {
+	allowPath := ResultPath{"allow"}
+	primary := NewDummyDecider(&OPADecision{ID: "primary", Result: map[string]interface{}{"allow": true}})
+	shadow := NewDummyDecider(&OPADecision{ID: "shadow", Result: map[string]interface{}{"allow": false}})
+	return NewShadowDecider(primary, shadow, allowPath, 0, disagreements, masks)
+}
+
+func TestShadowDeciderMasksInput(t *testing.T) {
+	masks := []ResultPath{{"jwt"}, {"context", "headers", "Authorization"}}
+	disagreements := &lockedBuffer{}
+	d := newDisagreeingShadowDecider(disagreements, masks)
+
+	input := map[string]interface{}{
+		"jwt":     "secret-token",
+		"subject": "alice",
+		"context": map[string]interface{}{
+			"headers": map[string]interface{}{"Authorization": "Bearer secret-token"},
+		},
+	}
+
+	decision, err := d.Decision(context.Background(), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.ID != "primary" {
+		t.Errorf("expected the primary decision, got %s", decision.ID)
+	}
+
+	err = d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logged := disagreements.String()
+	if strings.Contains(logged, "secret-token") {
+		t.Errorf("secret was written to the shadow log: %s", logged)
+	}
+
+	var disagreement ShadowDisagreement
+	err = json.Unmarshal([]byte(logged), &disagreement)
+	if err != nil {
+		t.Fatalf("failed to parse shadow log %q: %v", logged, err)
+	}
+
+	masked := disagreement.Input.(map[string]interface{})
+	if masked["jwt"] != maskedValue || masked["subject"] != "alice" {
+		t.Errorf("unexpected logged input %v", masked)
+	}
+
+	// The caller's input must not be modified.
+	if input["jwt"] != "secret-token" {
+		t.Errorf("input was modified: %v", input)
+	}
+
+	if stats := d.Stats(); stats.Compared != 1 || stats.Disagreed != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestShadowDeciderAfterClose(t *testing.T) {
+	d := newDisagreeingShadowDecider(&lockedBuffer{}, nil)
+
+	// Requests which outlive the server's shutdown may still ask for
+	// decisions while, and after, the decider is closed.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, err := d.Decision(context.Background(), map[string]interface{}{})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	err := d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	err = d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decision, err := d.Decision(context.Background(), map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.ID != "primary" {
+		t.Errorf("expected the primary decision after close, got %s", decision.ID)
+	}
+
+	if stats := d.Stats(); stats.Compared+stats.Dropped != 801 {
+		t.Errorf("expected every evaluation to be compared or dropped, got %+v", stats)
+	}
+}
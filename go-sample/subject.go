@@ -0,0 +1,356 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+//
+// This file implements the SubjectResolvers which establish who is making
+// each request, before OPA is asked whether it is allowed. Besides the User
+// header and JWTs (see jwt.go), requests may be authenticated with a TLS
+// client certificate, HTTP Basic credentials checked against an htpasswd
+// file, or a static API key.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// ErrInvalidCredentials is wrapped by the errors returned by the
+// SubjectResolvers in this file when a request's credentials are rejected.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Identity is the identity of the subject of a request, as established by a
+// SubjectResolver. It is used to populate the EntitlementsInput.
+type Identity struct {
+	Subject    string
+	Roles      []string
+	Groups     []string
+	Attributes map[string]string
+
+	// JWT is the bearer token the identity was established from, if
+	// any.
+	JWT string
+}
+
+// SubjectResolver establishes the identity of the subject of a request from
+// one kind of credentials.
+type SubjectResolver interface {
+	// ResolveSubject returns the identity established by the request's
+	// credentials. It returns nil and no error if the request does not
+	// carry credentials of the kind the resolver handles, so that the
+	// next resolver in a chain can be tried, and an error if it carries
+	// credentials which are invalid.
+	ResolveSubject(r *http.Request) (*Identity, error)
+
+	// Challenge returns the WWW-Authenticate challenge for the
+	// credentials the resolver handles, or "" if there is none.
+	Challenge() string
+}
+
+// Assert compliance with SubjectResolver
+var _ SubjectResolver = UserHeaderResolver{}
+var _ SubjectResolver = (*ClientCertResolver)(nil)
+var _ SubjectResolver = (*HtpasswdResolver)(nil)
+var _ SubjectResolver = (*APIKeyResolver)(nil)
+
+// UserHeaderResolver takes the subject from the User header, without any
+// authentication. It is what EntitlementsHandler uses if no other
+// SubjectResolvers are configured.
+type UserHeaderResolver struct{}
+
+// ResolveSubject implements SubjectResolver.ResolveSubject.
+func (UserHeaderResolver) ResolveSubject(r *http.Request) (*Identity, error) {
+	user := r.Header.Get("User")
+	if user == "" {
+		return nil, nil
+	}
+	return &Identity{Subject: user}, nil
+}
+
+// Challenge implements SubjectResolver.Challenge.
+func (UserHeaderResolver) Challenge() string {
+	return ""
+}
+
+// ClientCertResolver takes the subject from the verified TLS client
+// certificate of the request. The organizational units of the certificate's
+// subject are used as the groups, and its issuer and serial number are
+// added to the subject attributes.
+//
+// The server must be configured to verify client certificates, e.g. with
+// tls.VerifyClientCertIfGiven, since certificates which were not verified
+// are rejected.
+type ClientCertResolver struct {
+	field string
+}
+
+// NewClientCertResolver instances a ClientCertResolver which takes the
+// subject from the given field of the certificate: "cn" for the subject's
+// common name, or "email", "dns" or "uri" for the first subject alternative
+// name of that type.
+func NewClientCertResolver(field string) (*ClientCertResolver, error) {
+	switch field {
+	case "cn", "email", "dns", "uri":
+		return &ClientCertResolver{field: field}, nil
+	default:
+		return nil, fmt.Errorf("certificate field '%s' is not one of cn, email, dns, uri", field)
+	}
+}
+
+// subject extracts the configured field from the certificate.
+func (c *ClientCertResolver) subject(cert *x509.Certificate) string {
+	switch c.field {
+	case "cn":
+		return cert.Subject.CommonName
+	case "email":
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case "dns":
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case "uri":
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	}
+	return ""
+}
+
+// ResolveSubject implements SubjectResolver.ResolveSubject.
+func (c *ClientCertResolver) ResolveSubject(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, nil
+	}
+
+	if len(r.TLS.VerifiedChains) == 0 {
+		return nil, fmt.Errorf("%w: client certificate was not verified", ErrInvalidCredentials)
+	}
+
+	cert := r.TLS.PeerCertificates[0]
+	subject := c.subject(cert)
+	if subject == "" {
+		return nil, fmt.Errorf("%w: client certificate has no %s", ErrInvalidCredentials, c.field)
+	}
+
+	return &Identity{
+		Subject: subject,
+		Groups:  cert.Subject.OrganizationalUnit,
+		Attributes: map[string]string{
+			"cert-issuer": cert.Issuer.String(),
+			"cert-serial": cert.SerialNumber.String(),
+		},
+	}, nil
+}
+
+// Challenge implements SubjectResolver.Challenge.
+func (c *ClientCertResolver) Challenge() string {
+	return ""
+}
+
+// readCredentialsFile reads a file of "name:secret" lines, as used by
+// htpasswd and API key files. Blank lines and lines starting with '#' are
+// skipped.
+func readCredentialsFile(path string, line func(name, secret string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+		n++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		name, secret, ok := strings.Cut(text, ":")
+		if !ok || name == "" || secret == "" {
+			return fmt.Errorf("%s:%d: expected 'name:secret'", path, n)
+		}
+
+		err = line(name, secret)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// HtpasswdResolver authenticates HTTP Basic credentials against the users
+// of an htpasswd file. Passwords must be hashed with bcrypt ("htpasswd -B")
+// or SHA1 ("htpasswd -s"); other schemes are rejected when the file is
+// loaded.
+//
+// Rejected credentials are reported with the same error whether the user is
+// unknown or the password is wrong, and take about as long to check, so that
+// clients cannot find out which users exist. The reason is only logged.
+type HtpasswdResolver struct {
+	realm  string
+	hashes map[string]string
+
+	// dummy is checked against the passwords given for unknown users.
+	dummy string
+}
+
+// errWrongPassword is returned by HtpasswdResolver for any rejected
+// credentials.
+var errWrongPassword = fmt.Errorf("%w: wrong user name or password", ErrInvalidCredentials)
+
+// NewHtpasswdResolver loads the htpasswd file at path. The realm is used in
+// the WWW-Authenticate challenge.
+func NewHtpasswdResolver(path, realm string) (*HtpasswdResolver, error) {
+	h := &HtpasswdResolver{
+		realm:  realm,
+		hashes: map[string]string{},
+	}
+
+	err := readCredentialsFile(path, func(user, hash string) error {
+		if !strings.HasPrefix(hash, "$2a$") && !strings.HasPrefix(hash, "$2b$") && !strings.HasPrefix(hash, "$2y$") && !strings.HasPrefix(hash, "{SHA}") {
+			return fmt.Errorf("password of user '%s' is not hashed with bcrypt or SHA1", user)
+		}
+
+		if _, ok := h.hashes[user]; ok {
+			return fmt.Errorf("user '%s' is listed more than once", user)
+		}
+
+		h.hashes[user] = hash
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The dummy hash uses the most expensive scheme in the file, so that
+	// unknown users take no less time to reject than known ones.
+	cost := 0
+	for _, hash := range h.hashes {
+		if c, err := bcrypt.Cost([]byte(hash)); err == nil && c > cost {
+			cost = c
+		}
+	}
+
+	h.dummy = "{SHA}"
+	if cost > 0 {
+		dummy, err := bcrypt.GenerateFromPassword([]byte("dummy"), cost)
+		if err != nil {
+			return nil, err
+		}
+		h.dummy = string(dummy)
+	}
+
+	return h, nil
+}
+
+// checkPassword returns true if the password matches the htpasswd hash.
+func checkPassword(hash, password string) bool {
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// ResolveSubject implements SubjectResolver.ResolveSubject.
+func (h *HtpasswdResolver) ResolveSubject(r *http.Request) (*Identity, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+
+	hash, ok := h.hashes[user]
+	if !ok {
+		checkPassword(h.dummy, password)
+		log.Printf("%s: rejecting HTTP Basic credentials of unknown user '%s'\n", r.RemoteAddr, user)
+		return nil, errWrongPassword
+	}
+
+	if !checkPassword(hash, password) {
+		log.Printf("%s: rejecting HTTP Basic credentials of user '%s': wrong password\n", r.RemoteAddr, user)
+		return nil, errWrongPassword
+	}
+
+	return &Identity{Subject: user}, nil
+}
+
+// Challenge implements SubjectResolver.Challenge.
+func (h *HtpasswdResolver) Challenge() string {
+	return fmt.Sprintf("Basic realm=%q", h.realm)
+}
+
+// APIKeyResolver authenticates requests by a static API key passed in a
+// header, such as X-API-Key.
+type APIKeyResolver struct {
+	header string
+
+	// subjects maps the SHA256 of each key to its subject, so that keys
+	// are not compared byte by byte.
+	subjects map[[sha256.Size]byte]string
+}
+
+// NewAPIKeyResolver loads the API keys in the file at path, which has a
+// "subject:key" line for each key. Keys are read from the given header.
+func NewAPIKeyResolver(path, header string) (*APIKeyResolver, error) {
+	a := &APIKeyResolver{
+		header:   header,
+		subjects: map[[sha256.Size]byte]string{},
+	}
+
+	err := readCredentialsFile(path, func(subject, key string) error {
+		sum := sha256.Sum256([]byte(key))
+		if _, ok := a.subjects[sum]; ok {
+			return fmt.Errorf("key of subject '%s' is already in use", subject)
+		}
+
+		a.subjects[sum] = subject
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// ResolveSubject implements SubjectResolver.ResolveSubject.
+func (a *APIKeyResolver) ResolveSubject(r *http.Request) (*Identity, error) {
+	key := r.Header.Get(a.header)
+	if key == "" {
+		return nil, nil
+	}
+
+	subject, ok := a.subjects[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown API key", ErrInvalidCredentials)
+	}
+
+	return &Identity{Subject: subject}, nil
+}
+
+// Challenge implements SubjectResolver.Challenge.
+func (a *APIKeyResolver) Challenge() string {
+	return ""
+}
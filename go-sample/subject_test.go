@@ -0,0 +1,259 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeCredentials writes the lines to a file in a temporary directory, and
+// returns its path.
+func writeCredentials(t *testing.T, lines string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "credentials")
+	err := os.WriteFile(path, []byte(lines), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeHtpasswd writes an htpasswd file in which alice's password is hashed
+// with bcrypt, and bob's with SHA1.
+func writeHtpasswd(t *testing.T) string {
+	t.Helper()
+
+	alice, err := bcrypt.GenerateFromPassword([]byte("pw1"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha1.Sum([]byte("pw2"))
+	bob := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+
+	return writeCredentials(t, "# users\nalice:"+string(alice)+"\n\nbob:"+bob+"\n")
+}
+
+func TestHtpasswdResolverHidesWhichUsersExist(t *testing.T) {
+	h, err := NewHtpasswdResolver(writeHtpasswd(t), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var messages []string
+	for _, credentials := range [][2]string{{"alice", "wrong"}, {"bob", "wrong"}, {"mallory", "pw1"}} {
+		r := httptest.NewRequest("GET", "/cars", nil)
+		r.SetBasicAuth(credentials[0], credentials[1])
+
+		id, err := h.ResolveSubject(r)
+		if id != nil || !errors.Is(err, ErrInvalidCredentials) {
+			t.Fatalf("%s: expected the credentials to be rejected, got %v, %v", credentials[0], id, err)
+		}
+		messages = append(messages, err.Error())
+	}
+
+	for _, message := range messages[1:] {
+		if message != messages[0] {
+			t.Errorf("expected every rejection to give the same error, got %q", messages)
+		}
+	}
+}
+
+func TestHtpasswdResolver(t *testing.T) {
+	h, err := NewHtpasswdResolver(writeHtpasswd(t), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for user, password := range map[string]string{"alice": "pw1", "bob": "pw2"} {
+		r := httptest.NewRequest("GET", "/cars", nil)
+		r.SetBasicAuth(user, password)
+
+		id, err := h.ResolveSubject(r)
+		if err != nil || id == nil || id.Subject != user {
+			t.Errorf("%s: expected the credentials to be accepted, got %v, %v", user, id, err)
+		}
+	}
+
+	id, err := h.ResolveSubject(httptest.NewRequest("GET", "/cars", nil))
+	if id != nil || err != nil {
+		t.Errorf("expected a request without credentials to be passed over, got %v, %v", id, err)
+	}
+
+	if challenge := h.Challenge(); challenge != `Basic realm="test"` {
+		t.Errorf("unexpected challenge %s", challenge)
+	}
+
+	_, err = NewHtpasswdResolver(writeCredentials(t, "carol:$apr1$salt$hash\n"), "test")
+	if err == nil {
+		t.Error("expected a file with MD5 hashes to be rejected")
+	}
+}
+
+func TestAPIKeyResolver(t *testing.T) {
+	a, err := NewAPIKeyResolver(writeCredentials(t, "alice:key1\nbob:key2\n"), "X-API-Key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, expected := range map[string]string{"key1": "alice", "key2": "bob"} {
+		r := httptest.NewRequest("GET", "/cars", nil)
+		r.Header.Set("X-API-Key", key)
+
+		id, err := a.ResolveSubject(r)
+		if err != nil || id == nil || id.Subject != expected {
+			t.Errorf("%s: expected subject %s, got %v, %v", key, expected, id, err)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/cars", nil)
+	r.Header.Set("X-API-Key", "key3")
+	if id, err := a.ResolveSubject(r); id != nil || !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected an unknown key to be rejected, got %v, %v", id, err)
+	}
+
+	id, err := a.ResolveSubject(httptest.NewRequest("GET", "/cars", nil))
+	if id != nil || err != nil {
+		t.Errorf("expected a request without a key to be passed over, got %v, %v", id, err)
+	}
+
+	_, err = NewAPIKeyResolver(writeCredentials(t, "alice:key1\nbob:key1\n"), "X-API-Key")
+	if err == nil {
+		t.Error("expected a key shared by two subjects to be rejected")
+	}
+}
+
+func TestClientCertResolver(t *testing.T) {
+	c, err := NewClientCertResolver("cn")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := &x509.Certificate{
+		Subject:      pkix.Name{CommonName: "alice", OrganizationalUnit: []string{"sales"}},
+		Issuer:       pkix.Name{CommonName: "Test CA"},
+		SerialNumber: big.NewInt(7),
+	}
+
+	r := httptest.NewRequest("GET", "/cars", nil)
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	if id, err := c.ResolveSubject(r); id != nil || !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected an unverified certificate to be rejected, got %v, %v", id, err)
+	}
+
+	r.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+	id, err := c.ResolveSubject(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Subject != "alice" || len(id.Groups) != 1 || id.Groups[0] != "sales" || id.Attributes["cert-serial"] != "7" {
+		t.Errorf("unexpected identity %+v", id)
+	}
+
+	id, err = c.ResolveSubject(httptest.NewRequest("GET", "/cars", nil))
+	if id != nil || err != nil {
+		t.Errorf("expected a request without a certificate to be passed over, got %v, %v", id, err)
+	}
+
+	if _, err := NewClientCertResolver("serial"); err == nil {
+		t.Error("expected an unknown certificate field to be rejected")
+	}
+}
+
+// serveAuthenticated sends a request with the given headers through an
+// EntitlementsHandler using the resolvers, and returns the response along
+// with the subject OPA was asked about.
+func serveAuthenticated(t *testing.T, required bool, resolvers []SubjectResolver, headers map[string]string, basic []string) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+
+	subject := ""
+	decider := deciderFunc(func(ctx context.Context, input interface{}) (*OPADecision, error) {
+		subject = input.(*EntitlementsInput).Subject
+		return &OPADecision{ID: "d1", Result: map[string]interface{}{"allow": true}}, nil
+	})
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := NewEntitlementsHandler(decider, ok, WithAllowPath(ResultPath{"allow"}), WithSubjectResolvers(required, resolvers...))
+
+	r := httptest.NewRequest("GET", "/cars", nil)
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	if basic != nil {
+		r.SetBasicAuth(basic[0], basic[1])
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w, subject
+}
+
+func TestSubjectResolverChain(t *testing.T) {
+	keys, err := NewAPIKeyResolver(writeCredentials(t, "carol:key1\n"), "X-API-Key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	htpasswd, err := NewHtpasswdResolver(writeHtpasswd(t), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolvers := []SubjectResolver{keys, htpasswd, UserHeaderResolver{}}
+
+	for _, test := range []struct {
+		name    string
+		headers map[string]string
+		basic   []string
+		code    int
+		subject string
+	}{
+		{"first resolver wins", map[string]string{"X-API-Key": "key1", "User": "dave"}, []string{"alice", "pw1"}, 200, "carol"},
+		{"later resolver", map[string]string{"User": "dave"}, []string{"alice", "pw1"}, 200, "alice"},
+		{"last resolver", map[string]string{"User": "dave"}, nil, 200, "dave"},
+		{"rejected credentials are not passed over", map[string]string{"X-API-Key": "key2"}, []string{"alice", "pw1"}, 401, ""},
+		{"no credentials", nil, nil, 200, ""},
+	} {
+		w, subject := serveAuthenticated(t, false, resolvers, test.headers, test.basic)
+		if w.Code != test.code || subject != test.subject {
+			t.Errorf("%s: expected %d for subject %q, got %d for subject %q: %s", test.name, test.code, test.subject, w.Code, subject, w.Body)
+		}
+	}
+}
+
+func TestSubjectRequired(t *testing.T) {
+	htpasswd, err := NewHtpasswdResolver(writeHtpasswd(t), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolvers := []SubjectResolver{htpasswd}
+
+	w, _ := serveAuthenticated(t, true, resolvers, nil, nil)
+	if w.Code != 401 || w.Header().Get("WWW-Authenticate") != `Basic realm="test"` {
+		t.Errorf("expected a challenge for a request without credentials, got %d %v", w.Code, w.Header())
+	}
+
+	w, subject := serveAuthenticated(t, true, resolvers, nil, []string{"bob", "pw2"})
+	if w.Code != 200 || subject != "bob" {
+		t.Errorf("expected bob to be authenticated, got %d for subject %q", w.Code, subject)
+	}
+
+	w, _ = serveAuthenticated(t, false, resolvers, nil, nil)
+	if w.Code != 200 {
+		t.Errorf("expected a request without credentials to be passed to OPA, got %d", w.Code)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2022 Styra Inc. All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package sample
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+//
+// This file holds the helpers used to trace requests with OpenTelemetry.
+// Spans are created with the global TracerProvider, and trace context is
+// propagated with the global TextMapPropagator, so both are no-ops unless
+// the program using this package configures them, as carinfoserver does
+// when tracing is enabled.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// tracer creates every span in this package. The global TracerProvider
+// delegates to whichever provider is installed later, so it is safe to
+// obtain the tracer before tracing is configured.
+var tracer = otel.Tracer("github.com/styrainc/entitlements-samples/go-sample")
+
+// endSpan records the error, if any, on the span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// startDecisionSpan starts the span for a single OPADecider.Decision call
+// by the given kind of decider.
+func startDecisionSpan(ctx context.Context, decider string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "OPADecider.Decision", trace.WithAttributes(
+		attribute.String("decider", decider),
+	))
+}
+
+// endDecisionSpan records the ID of the decision on the span, or the error
+// if there was no decision, and ends it.
+func endDecisionSpan(span trace.Span, decision *OPADecision, err error) {
+	if decision != nil {
+		span.SetAttributes(attribute.String("decision.id", decision.ID))
+	}
+	endSpan(span, err)
+}
+
+// Assert compliance with CarStore
+var _ CarStore = (*tracedStore)(nil)
+
+// tracedStore wraps a CarStore, creating a span for each operation as a
+// child of the span in ctx. Since the CarStore methods do not take a
+// context, one is created for each request.
+type tracedStore struct {
+	store CarStore
+	ctx   context.Context
+}
+
+// start starts the span for an operation on the car with the given ID, or
+// on the whole store if id is empty.
+func (t *tracedStore) start(operation, id string) trace.Span {
+	_, span := tracer.Start(t.ctx, "CarStore."+operation)
+	if id != "" {
+		span.SetAttributes(attribute.String("car.id", id))
+	}
+	return span
+}
+
+// GetCarIDs implements CarStore.GetCarIDs.
+func (t *tracedStore) GetCarIDs() ([]string, error) {
+	span := t.start("GetCarIDs", "")
+	ids, err := t.store.GetCarIDs()
+	endSpan(span, err)
+	return ids, err
+}
+
+// GetCar implements CarStore.GetCar.
+func (t *tracedStore) GetCar(id string) (Car, uint64, error) {
+	span := t.start("GetCar", id)
+	car, rev, err := t.store.GetCar(id)
+	endSpan(span, err)
+	return car, rev, err
+}
+
+// SetCar implements CarStore.SetCar.
+func (t *tracedStore) SetCar(id string, car Car, pre Precondition, author Author) (uint64, uint64, error) {
+	span := t.start("SetCar", id)
+	prev, rev, err := t.store.SetCar(id, car, pre, author)
+	endSpan(span, err)
+	return prev, rev, err
+}
+
+// DeleteCar implements CarStore.DeleteCar.
+func (t *tracedStore) DeleteCar(id string, pre Precondition, author Author) error {
+	span := t.start("DeleteCar", id)
+	err := t.store.DeleteCar(id, pre, author)
+	endSpan(span, err)
+	return err
+}
+
+// SetStatus implements CarStore.SetStatus.
+func (t *tracedStore) SetStatus(id string, status Status, pre Precondition, author Author) (uint64, uint64, error) {
+	span := t.start("SetStatus", id)
+	prev, rev, err := t.store.SetStatus(id, status, pre, author)
+	endSpan(span, err)
+	return prev, rev, err
+}
+
+// GetStatus implements CarStore.GetStatus.
+func (t *tracedStore) GetStatus(id string) (Status, uint64, error) {
+	span := t.start("GetStatus", id)
+	status, rev, err := t.store.GetStatus(id)
+	endSpan(span, err)
+	return status, rev, err
+}
+
+// GetHistory implements CarStore.GetHistory.
+func (t *tracedStore) GetHistory(id string) ([]HistoryEntry, error) {
+	span := t.start("GetHistory", id)
+	history, err := t.store.GetHistory(id)
+	endSpan(span, err)
+	return history, err
+}
+
+// NextCarID implements CarStore.NextCarID.
+func (t *tracedStore) NextCarID() (string, error) {
+	span := t.start("NextCarID", "")
+	id, err := t.store.NextCarID()
+	endSpan(span, err)
+	return id, err
+}
+
+// Close implements CarStore.Close. The underlying store is shared between
+// requests, so it is not closed.
+func (t *tracedStore) Close() error {
+	return nil
+}